@@ -0,0 +1,151 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// acl is a list of networks and TSIG key names. Single addresses are stored
+// as a /32 or /128.
+type acl struct {
+	nets []*net.IPNet
+	keys map[string]bool
+}
+
+// newAcl parses a list of IP addresses, networks in CIDR notation and TSIG
+// key names, the latter as "key:<name>".
+func newAcl(list []string) (acl, error) {
+	a := acl{nets: make([]*net.IPNet, 0, len(list)), keys: make(map[string]bool)}
+	for _, l := range list {
+		if strings.HasPrefix(l, "key:") {
+			a.keys[dns.Fqdn(strings.ToLower(l[4:]))] = true
+			continue
+		}
+		if !strings.Contains(l, "/") {
+			ip := net.ParseIP(l)
+			if ip == nil {
+				return a, fmt.Errorf("invalid address in acl: %q", l)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			a.nets = append(a.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(l)
+		if err != nil {
+			return a, err
+		}
+		a.nets = append(a.nets, n)
+	}
+	return a, nil
+}
+
+// empty returns true when a has no entries.
+func (a acl) empty() bool {
+	return len(a.nets) == 0 && len(a.keys) == 0
+}
+
+// contains returns true when ip is in one of the networks of a, or key is
+// one of the TSIG keys of a.
+func (a acl) contains(ip net.IP, key string) bool {
+	if key != "" && a.keys[key] {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tsigKey returns the name of the TSIG key req is signed with, or "" when
+// it isn't signed or the signature doesn't verify. The key name identifies
+// the client, also when its address doesn't (i.e. behind NAT).
+func tsigKey(w dns.ResponseWriter, req *dns.Msg) string {
+	t := req.IsTsig()
+	if t == nil || w.TsigStatus() != nil {
+		return ""
+	}
+	return strings.ToLower(t.Hdr.Name)
+}
+
+// tsigWriter signs the replies to a TSIG signed query with the same key.
+type tsigWriter struct {
+	dns.ResponseWriter
+	t *dns.TSIG
+}
+
+func (w *tsigWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() == nil {
+		m.SetTsig(w.t.Hdr.Name, w.t.Algorithm, 300, time.Now().Unix())
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// remoteIP returns the address of the client, unlike clientIP the EDNS0
+// subnet option is ignored as it is trivially spoofed.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// queryAllowed checks if the client with address ip and TSIG key may query
+// us. Denied clients are always refused, when AllowQuery is set only those
+// clients may query.
+func (s *server) queryAllowed(ip net.IP, key string) bool {
+	if s.config.denyQuery.contains(ip, key) {
+		return false
+	}
+	return s.config.allowQuery.empty() || s.config.allowQuery.contains(ip, key)
+}
+
+// forwardAllowed checks if the client may have its queries forwarded. When
+// AllowForward is empty everyone may.
+func (s *server) forwardAllowed(ip net.IP, key string) bool {
+	return s.config.allowForward.empty() || s.config.allowForward.contains(ip, key)
+}
+
+// transferAllowed checks if the client is allowed to do a zone transfer.
+func (s *server) transferAllowed(ip net.IP, key string) bool {
+	return s.config.axfrAllow.contains(ip, key)
+}
+
+// visible returns the services in sx the client with TSIG key may see:
+// services with Views set are only seen by clients using one of those keys.
+func visible(sx []*Service, key string) []*Service {
+	ok := sx[:0]
+	for _, serv := range sx {
+		if serv.visibleTo(key) {
+			ok = append(ok, serv)
+		}
+	}
+	return ok
+}
+
+// ServeDNSRefused sends back a REFUSED response.
+func (s *server) ServeDNSRefused(w dns.ResponseWriter, req *dns.Msg) {
+	statsRefusedCount.Add(1)
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
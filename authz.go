@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// authzRequest is sent to the authorization webhook.
+type authzRequest struct {
+	Subject   string `json:"subject"`
+	Name      string `json:"name"`
+	Operation string `json:"operation"` // "register" or "delete"
+}
+
+var authzClient = &http.Client{Timeout: 2 * time.Second}
+
+// authorized asks the webhook in AuthzURL if the client of req may do
+// operation on name. The webhook must return 200 OK to allow it, anything
+// else, including failing to reach the webhook, denies it. Clients that did
+// not authenticate are denied without asking. Without AuthzURL everything is
+// allowed.
+func (s *server) authorized(req *http.Request, name, operation string) bool {
+	if s.config.AuthzURL == "" {
+		return true
+	}
+	sub := s.subject(req)
+	if sub == "" {
+		return false
+	}
+	body, err := json.Marshal(&authzRequest{Subject: sub, Name: name, Operation: operation})
+	if err != nil {
+		return false
+	}
+	resp, err := authzClient.Post(s.config.AuthzURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logf("error: Failure to reach authorization webhook: %q", err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// subject identifies the client of req: the common name of its TLS client
+// certificate, when verified with TLSClientCA, or the user of its basic
+// authentication, when the password matches the one in HttpUsers. It is ""
+// when the client did not authenticate.
+func (s *server) subject(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		return req.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		if p, found := s.config.HttpUsers[user]; found && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			return user
+		}
+	}
+	return ""
+}
+
+// authenticate only passes requests to h from clients that authenticate,
+// when HttpUsers or TLSClientCA are set. Others get a 401 Unauthorized.
+func (s *server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if (len(s.config.HttpUsers) > 0 || s.config.TLSClientCA != "") && s.subject(req) == "" {
+			if len(s.config.HttpUsers) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="skydns"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// canary publishes a TXT record canary.<instance>.dns.<domain> holding the
+// current time (in seconds since the epoch) every interval. External
+// monitors can use this to measure the propagation delay from etcd to DNS
+// for each instance. The key expires when we stop refreshing it. It returns
+// when the server stops.
+func (s *server) canary() {
+	name := "canary." + s.config.Instance + ".dns." + s.config.Domain
+	ttl := uint64(3 * s.config.CanaryInterval / time.Second)
+	if ttl == 0 {
+		ttl = 1
+	}
+	for {
+		value, _ := json.Marshal(&Service{Text: strconv.FormatInt(time.Now().Unix(), 10)})
+		if _, err := s.client.Set(path(name), string(value), ttl); err != nil {
+			log.Printf("error: Failure to publish canary %q: %q", name, err)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.config.CanaryInterval):
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Check is a health check for a service. Type is either "tcp" or "http",
+// for "http" the check succeeds when a GET of Path returns a 2xx or 3xx
+// status. Port defaults to the port of the service.
+type Check struct {
+	Type string
+	Path string `json:",omitempty"`
+	Port int    `json:",omitempty"`
+}
+
+// checker runs the health checks for the services we have seen. Services
+// are registered when they are looked up and forgotten when they haven't
+// been looked up for 10 intervals.
+type checker struct {
+	sync.RWMutex
+	interval time.Duration
+	checks   map[string]*checkState // keyed by etcd key
+}
+
+type checkState struct {
+	check   Check // as configured, see addr for the port
+	host    string
+	port    int // of the service
+	seen    time.Time
+	healthy bool
+}
+
+func newChecker(interval time.Duration) *checker {
+	return &checker{interval: interval, checks: make(map[string]*checkState)}
+}
+
+// healthy registers the check of serv and returns the result of the last
+// check. Services without a check and services that have not been checked
+// yet are healthy.
+func (c *checker) healthy(serv *Service) bool {
+	if serv.Check == nil {
+		return true
+	}
+	c.Lock()
+	defer c.Unlock()
+	st, ok := c.checks[serv.key]
+	if !ok || st.check != *serv.Check || st.host != serv.Host || st.port != serv.Port {
+		st = &checkState{check: *serv.Check, host: serv.Host, port: serv.Port, healthy: true}
+		c.checks[serv.key] = st
+	}
+	st.seen = time.Now()
+	return st.healthy
+}
+
+// run periodically runs all checks. It blocks, so should be run in a goroutine.
+// It returns when stop is closed.
+func (c *checker) run(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.interval):
+		}
+		c.RLock()
+		checks := make(map[string]checkState, len(c.checks))
+		for k, st := range c.checks {
+			checks[k] = *st
+		}
+		c.RUnlock()
+
+		results := c.probeAll(checks)
+
+		c.Lock()
+		for k, ok := range results {
+			st, found := c.checks[k]
+			if !found {
+				continue
+			}
+			if st.healthy != ok {
+				log.Printf("Health check of %q is now: %t", k, ok)
+			}
+			st.healthy = ok
+			if time.Since(st.seen) > 10*c.interval {
+				delete(c.checks, k)
+			}
+		}
+		c.Unlock()
+	}
+}
+
+// addr returns the address to check, the port defaults to that of the
+// service.
+func (st checkState) addr() string {
+	port := st.check.Port
+	if port == 0 {
+		port = st.port
+	}
+	return net.JoinHostPort(st.host, strconv.Itoa(port))
+}
+
+// checkWorkers is the number of checks that run at the same time.
+const checkWorkers = 16
+
+// probeAll runs checks concurrently, with at most checkWorkers at a time, and
+// returns their results. Each gets half the interval, up to 5 seconds, so a
+// round does not take longer than the interval with a few dead services.
+func (c *checker) probeAll(checks map[string]checkState) map[string]bool {
+	timeout := c.interval / 2
+	if timeout > 5*time.Second {
+		timeout = 5 * time.Second
+	}
+	type result struct {
+		key string
+		ok  bool
+	}
+	keys := make(chan string)
+	out := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < checkWorkers && i < len(checks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keys {
+				st := checks[k]
+				out <- result{k, probe(st.addr(), st.check, timeout)}
+			}
+		}()
+	}
+	go func() {
+		for k := range checks {
+			keys <- k
+		}
+		close(keys)
+		wg.Wait()
+		close(out)
+	}()
+	results := make(map[string]bool, len(checks))
+	for r := range out {
+		results[r.key] = r.ok
+	}
+	return results
+}
+
+// probe runs a single check against addr.
+func probe(addr string, check Check, timeout time.Duration) bool {
+	switch check.Type {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case "http":
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get("http://" + addr + check.Path)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckDefaultPort(t *testing.T) {
+	// A port nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	c := newChecker(time.Second)
+	serv := &Service{Host: "127.0.0.1", Port: port, Check: &Check{Type: "tcp"}, key: "/skydns/local/skydns/web/1"}
+	if !c.healthy(serv) {
+		t.Fatal("expected a service that is not checked yet to be healthy")
+	}
+	st := c.checks[serv.key]
+	if st.check != *serv.Check {
+		t.Errorf("expected the check as configured, got %v", st.check)
+	}
+	if addr := st.addr(); addr != "127.0.0.1:"+strconv.Itoa(port) {
+		t.Errorf("expected the port of the service in the address, got %q", addr)
+	}
+
+	results := c.probeAll(map[string]checkState{serv.key: *st})
+	if results[serv.key] {
+		t.Fatalf("expected the check of a closed port to fail")
+	}
+	st.healthy = results[serv.key]
+
+	again := &Service{Host: "127.0.0.1", Port: port, Check: &Check{Type: "tcp"}, key: serv.key}
+	if c.healthy(again) {
+		t.Errorf("expected the service to stay unhealthy on the next lookup")
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// Errors returned when getting services from the backend.
+var (
+	ErrNotFound    = errors.New("skydns: name not found")
+	ErrUnavailable = errors.New("skydns: backend unavailable")
+	ErrBadData     = errors.New("skydns: bad data in backend")
+)
+
+var getInflight = new(getSingle)
+
+// backendError converts an error returned by etcd to one of our errors.
+func backendError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 100 {
+		return ErrNotFound
+	}
+	return ErrUnavailable
+}
+
+// get returns the (recursive) contents of key, either from a frozen subtree,
+// the in-memory zone or from etcd. Frozen subtrees below key replace the ones
+// read from the zone or etcd. Concurrent gets for the same key to etcd are
+// suppressed: only one request is made and the response is shared.
+// Errors are either ErrNotFound or ErrUnavailable. When MaxStale is set and
+// etcd is unavailable, the last good response is returned instead.
+func (s *server) get(key string) (*etcd.Response, error) {
+	if r, ok := s.frozen.get(key); ok {
+		if r == nil {
+			return nil, ErrNotFound
+		}
+		return r, nil
+	}
+	r, err := s.getUnfrozen(key)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if r = s.frozen.overlay(key, r); r == nil {
+		return nil, ErrNotFound
+	}
+	return r, nil
+}
+
+// getUnfrozen returns the (recursive) contents of key from the in-memory zone
+// or from etcd.
+func (s *server) getUnfrozen(key string) (*etcd.Response, error) {
+	if s.zone != nil {
+		return s.zone.Get(key)
+	}
+	start := time.Now()
+	r, err, shared := getInflight.Do(key, func() (*etcd.Response, error) {
+		return s.client.Get(key, false, true)
+	})
+	statsBackendDuration.observe(time.Since(start))
+	if shared {
+		statsInflightSharedCount.Add(1)
+		statsInflightShared.Add(key, 1)
+	}
+	if err != nil {
+		e := backendError(err)
+		if e == ErrUnavailable {
+			logf("error: Failure to get %q from etcd: %q", key, err)
+			if s.stale != nil {
+				if r := s.stale.get(key); r != nil {
+					statsServeStaleCount.Add(1)
+					return r, nil
+				}
+			}
+		}
+		return nil, e
+	}
+	if s.stale != nil {
+		s.stale.set(key, r)
+	}
+	return r, nil
+}
+
+// Adapted from singleinflight.go from the original Go Code. Copyright 2013 The Go Authors.
+type getCall struct {
+	wg   sync.WaitGroup
+	val  *etcd.Response
+	err  error
+	dups int
+}
+
+type getSingle struct {
+	sync.Mutex
+	m map[string]*getCall
+}
+
+func (g *getSingle) Do(key string, fn func() (*etcd.Response, error)) (*etcd.Response, error, bool) {
+	g.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*getCall)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := new(getCall)
+	c.wg.Add(1)
+	g.m[key] = c
+	g.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	g.Lock()
+	delete(g.m, key)
+	g.Unlock()
+
+	return c.val, c.err, c.dups > 0
+}
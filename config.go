@@ -7,7 +7,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net"
+	"os"
 	"strings"
 	"time"
 
@@ -17,28 +19,298 @@ import (
 
 // Config provides options to the skydns resolver
 type Config struct {
-	DnsAddr      string        `json:"dns_addr,omitempty"`
+	// DnsAddr is a comma separated list of addresses to listen on, TCPAddr
+	// and UDPAddr replace it for TCP or UDP only.
+	DnsAddr string `json:"dns_addr,omitempty"`
+	TCPAddr string `json:"tcp_addr,omitempty"`
+	UDPAddr string `json:"udp_addr,omitempty"`
+
+	// UDPWorkers opens this many UDP sockets per address with SO_REUSEPORT
+	// (Linux only), so reading packets is spread over more cores.
+	UDPWorkers int `json:"udp_workers,omitempty"`
+
 	Domain       string        `json:"domain,omitempty"`
 	DomainLabels int           `json:"-"`
+	Domains      []string      `json:"domains,omitempty"`
 	DNSSEC       string        `json:"dnssec,omitempty"`
 	RoundRobin   bool          `json:"round_robin,omitempty"`
 	Nameservers  []string      `json:"nameservers,omitempty"`
 	ReadTimeout  time.Duration `json:"read_timeout,omitempty"`
 	WriteTimeout time.Duration `json:"write_timeout,omitempty"`
 
-	// DNSSEC key material
-	PubKey  *dns.DNSKEY    `json:"-"`
-	KeyTag  uint16         `json:"-"`
-	PrivKey dns.PrivateKey `json:"-"`
+	// Ttl is the TTL of records without one, MinTtl the TTL of records that
+	// change often and the SOA minimum. Defaults to 3600 and 60.
+	Ttl    uint32 `json:"ttl,omitempty"`
+	MinTtl uint32 `json:"min_ttl,omitempty"`
+
+	// Verbose enables extra logging.
+	Verbose bool `json:"verbose,omitempty"`
+	// LogLimit is the number of similar error messages logged per second,
+	// the rest is suppressed. Defaults to 10, -1 disables the limit.
+	LogLimit int `json:"log_limit,omitempty"`
+
+	// StaticRecords are records in text format, i.e. "skydns.local. IN MX 10
+	// mail.example.com.", for names in our domain that are answered without
+	// looking in etcd. These can be changed at runtime.
+	StaticRecords []string `json:"static_records,omitempty"`
+	staticRecords map[string][]dns.RR
+
+	// StaticNS holds the addresses for the nameserver of the domain, these
+	// are used when the etcd machines are not known.
+	StaticNS []string `json:"static_ns,omitempty"`
+
+	// QueryLog enables logging each query as JSON to this file, "-" is stderr.
+	// QueryLogSample is the fraction of the queries that is logged, defaults
+	// to 1. When the file grows beyond QueryLogSize MB it is rotated, 0 means
+	// it is never rotated.
+	QueryLog       string  `json:"query_log,omitempty"`
+	QueryLogSample float64 `json:"query_log_sample,omitempty"`
+	QueryLogSize   int     `json:"query_log_size,omitempty"`
+
+	// Instance is the name of this SkyDNS instance, defaults to the hostname.
+	Instance string `json:"instance,omitempty"`
+	// Origin adds the instance and the path (zone, etcd or forward) that
+	// produced the answer to each reply, either as an EDNS0 option ("edns")
+	// or as a CH TXT record in the additional section ("txt").
+	Origin string `json:"origin,omitempty"`
+
+	// HttpAddr enables the HTTP API, TLSCert and TLSKey enable HTTPS on it.
+	HttpAddr string `json:"http_addr,omitempty"`
+	TLSCert  string `json:"tls_cert,omitempty"`
+	TLSKey   string `json:"tls_key,omitempty"`
+	// HttpUsers maps users to their password, for basic authentication to the
+	// HTTP API. TLSClientCA is a CA bundle to verify TLS client certificates
+	// with. When either is set clients of the registration API, the cache and
+	// /debug/vars must authenticate, see authenticate.
+	HttpUsers   map[string]string `json:"http_users,omitempty"`
+	TLSClientCA string            `json:"tls_client_ca,omitempty"`
+	// AuthzURL is a webhook that authorizes registrations and deletions done
+	// with the HTTP API, see authorized. It needs HttpUsers or TLSClientCA.
+	AuthzURL string `json:"authz_url,omitempty"`
+
+	// FlatKeys stores every name under a single key, i.e. the key of
+	// service.staging.skydns.local. is /skydns/local.skydns.staging.service,
+	// instead of a directory per label. This keeps the tree shallow, but a
+	// name no longer includes the names below it.
+	FlatKeys bool `json:"flat_keys,omitempty"`
+
+	// Preload keeps a copy of the tree in memory. Grace is the time expired
+	// services are still served, at the lowest priority, this only works when
+	// Preload is set.
+	Preload bool          `json:"preload,omitempty"`
+	Grace   time.Duration `json:"grace,omitempty"`
+
+	// MaxStale is how long the last good answers are used when etcd is
+	// unavailable (RFC 8767). This only works without Preload, with Preload
+	// use Grace instead.
+	MaxStale time.Duration `json:"max_stale,omitempty"`
+
+	// ForwardStale is how long the last good forwarded replies are used when
+	// none of the nameservers respond. These replies have a TTL of 0.
+	ForwardStale time.Duration `json:"forward_stale,omitempty"`
+
+	// WarmUp is the time it takes for new services to get their full SRV
+	// weight, counted from their registration.
+	WarmUp time.Duration `json:"warm_up,omitempty"`
+
+	// ApexSRV allows SRV queries for the domain itself, which enumerates the
+	// entire tree, up to ApexSRVLimit services.
+	ApexSRV      bool `json:"apex_srv,omitempty"`
+	ApexSRVLimit int  `json:"apex_srv_limit,omitempty"`
+
+	// MaxExtra limits the number of addresses for SRV targets in the
+	// additional section, when there are more these are picked at random.
+	// 0 means no limit.
+	MaxExtra int `json:"max_extra,omitempty"`
+
+	// Dedup removes duplicate records from replies, i.e. the addresses of
+	// a target that is returned for more than one SRV record.
+	Dedup bool `json:"dedup,omitempty"`
+
+	// AutoPTR maintains PTR records in etcd for the addresses of the services
+	// in our domains, see maintainPTR.
+	AutoPTR bool `json:"auto_ptr,omitempty"`
+
+	// ZoneStats is the interval between counting the services, addresses
+	// and CNAMEs in our zones, these are exported as skydns_zone_counts.
+	// 0 disables counting.
+	ZoneStats time.Duration `json:"zone_stats,omitempty"`
+
+	// QueryTimeout limits the time spent gathering the records for a reply,
+	// what we have by then is returned, or SERVFAIL when we have nothing or
+	// QueryTimeoutServfail is set. A single etcd request is not interrupted.
+	// 0 means no limit.
+	QueryTimeout         time.Duration `json:"query_timeout,omitempty"`
+	QueryTimeoutServfail bool          `json:"query_timeout_servfail,omitempty"`
+
+	// AddressWeights orders the addresses in replies by the Weight of their
+	// services, a random order where heavier services are more likely to come
+	// first, instead of round robin.
+	AddressWeights bool `json:"address_weights,omitempty"`
+
+	// Seed seeds the random number generator used for round robin, so the
+	// order of the records is reproducible, i.e. in tests. 0 uses the time.
+	Seed int64 `json:"seed,omitempty"`
+
+	// CNAMEPolicy is what we do with services that have a name outside our
+	// domains as Host, these are returned as a CNAME and: "follow" (the
+	// default) looks up the target with our nameservers, "return" leaves
+	// this to the client and "reject" refuses these when registered.
+	CNAMEPolicy string `json:"cname_policy,omitempty"`
+
+	// MaxValueSize is the maximum size in bytes of a service, larger ones are
+	// refused by the registration API and skipped when read from etcd.
+	// 0 means no limit.
+	MaxValueSize int `json:"max_value_size,omitempty"`
+
+	// MaxAnswers limits the number of addresses and SRV records in a reply,
+	// when there are more a random subset is returned (following
+	// AddressWeights for addresses, the lowest priorities for SRV records),
+	// so the reply fits in a UDP packet. 0 means no limit.
+	MaxAnswers int `json:"max_answers,omitempty"`
+
+	// Mirror is the address of a nameserver that gets a copy of a sample
+	// (MirrorSample, defaults to 1) of the queries we get, over UDP.
+	Mirror       string  `json:"mirror,omitempty"`
+	MirrorSample float64 `json:"mirror_sample,omitempty"`
+
+	// PostProcess is a program, or with "unix:<path>" a service on a unix
+	// socket, that gets the answer to each query for our domains as a line
+	// of JSON and sends it back, possibly changed, the same way. When it
+	// fails or takes longer than PostProcessTimeout (default 100ms) the
+	// answer is sent as is.
+	PostProcess        string        `json:"post_process,omitempty"`
+	PostProcessTimeout time.Duration `json:"post_process_timeout,omitempty"`
+
+	// Compress enables name compression for replies larger than this many
+	// bytes, smaller ones aren't worth the CPU. 0 means no compression.
+	Compress int `json:"compress,omitempty"`
+
+	// Truncate is what we do with UDP replies larger than the buffer size of
+	// the client: "truncate" (the default) sets TC, "drop-extra" first drops
+	// the additional section, "trim" drops additional records and then
+	// answers until the reply fits, and "pad-to-advertised" does the same but
+	// sets TC whenever records were dropped. The buffer size is 512 for
+	// clients without EDNS0.
+	Truncate string `json:"truncate,omitempty"`
+
+	// Geo maps networks to locations and GeoFile holds more of these, when
+	// set addresses in the same location as the client are returned first
+	// for names in GeoZones, or all names if GeoZones is empty.
+	Geo      map[string]string `json:"geo,omitempty"`
+	GeoFile  string            `json:"geo_file,omitempty"`
+	GeoZones []string          `json:"geo_zones,omitempty"`
+	geo      *geoTable
+
+	// Hosts are dnsmasq style hosts files, the names in these are answered
+	// as well. The files are reread when they change.
+	Hosts []string `json:"hosts,omitempty"`
+	hosts *hosts
+
+	// Docker is the socket of the Docker daemon, when set the running
+	// containers are registered under DockerDomain, which defaults to
+	// docker.<domain>.
+	Docker       string `json:"docker,omitempty"`
+	DockerDomain string `json:"docker_domain,omitempty"`
+
+	// Marathon is the URL of Marathon, when set the tasks of the apps are
+	// registered under MarathonDomain, which defaults to marathon.<domain>.
+	// Marathon is polled every MarathonInterval, defaults to 10s.
+	Marathon         string        `json:"marathon,omitempty"`
+	MarathonDomain   string        `json:"marathon_domain,omitempty"`
+	MarathonInterval time.Duration `json:"marathon_interval,omitempty"`
+
+	// CheckInterval enables the health checks of services.
+	CheckInterval time.Duration `json:"check_interval,omitempty"`
+
+	// ForwardRace sends forwarded queries to this many nameservers, the ones
+	// with the lowest round trip time, at the same time. The first answer wins.
+	ForwardRace int `json:"forward_race,omitempty"`
+	// ForwardCheck is the interval for checking if the nameservers are alive,
+	// dead ones are skipped when forwarding.
+	ForwardCheck time.Duration `json:"forward_check,omitempty"`
+
+	// CanaryInterval enables publishing a canary record for this instance.
+	CanaryInterval time.Duration `json:"canary_interval,omitempty"`
+
+	// Update enables dynamic updates (RFC 2136), when TsigSecret is set
+	// updates must be signed with one of those keys.
+	Update     bool              `json:"update,omitempty"`
+	TsigSecret map[string]string `json:"tsig_secret,omitempty"`
+
+	// AxfrAllow lists the addresses and networks that may transfer the zone.
+	AxfrAllow []string `json:"axfr_allow,omitempty"`
+	axfrAllow acl
+
+	// AllowQuery lists the addresses and networks that may query us, when
+	// empty everyone may. DenyQuery is always refused. AllowForward lists
+	// the ones whose queries we forward, when empty everyone's.
+	AllowQuery   []string `json:"allow_query,omitempty"`
+	DenyQuery    []string `json:"deny_query,omitempty"`
+	AllowForward []string `json:"allow_forward,omitempty"`
+	allowQuery   acl
+	denyQuery    acl
+	allowForward acl
+
+	// ListenDegrade keeps SkyDNS running when only one of the TCP or UDP
+	// listeners fails, ListenRetries is the number of times we retry when
+	// the address is in use, -1 disables the retries.
+	ListenDegrade bool `json:"listen_degrade,omitempty"`
+	ListenRetries int  `json:"listen_retries,omitempty"`
+
+	// AllowedTypes lists the query types we answer, i.e. ["A", "AAAA", "SRV"],
+	// other types get NODATA (for our domain) or NOTIMP without a lookup.
+	// When empty all types are allowed.
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+	allowedTypes map[uint16]bool
+
+	// ForwardSpecialUse forwards the queries for the special-use domains
+	// (localhost., invalid., test.) and the reverse zones of private
+	// addresses, by default we answer these ourselves.
+	ForwardSpecialUse bool `json:"forward_special_use,omitempty"`
+
+	// MultiQuestion answers the first question of queries with more than one
+	// question, by default these get a FORMERR.
+	MultiQuestion bool `json:"multi_question,omitempty"`
+
+	// MalformedThreshold is the number of malformed packets per minute after
+	// which the source is logged, 0 disables the logging.
+	MalformedThreshold int `json:"malformed_threshold,omitempty"`
+
+	// SCache is the maximum number of cached DNSSEC signatures, 0 means no
+	// limit. It can be changed at runtime.
+	SCache int `json:"scache,omitempty"`
+
+	// NSEC3 denies names and types with NSEC3 records instead of NSEC, see
+	// server.nsec3. The keys can't use RSASHA1.
+	NSEC3 bool `json:"nsec3,omitempty"`
+
+	// ReverseZones are the reverse zones (i.e. 10.in-addr.arpa.) we are
+	// authoritative for, these are added to Domains. PTR queries for these
+	// are answered with SOA and NS records, NXDOMAIN and, with a key in
+	// DomainKeys, signed.
+	ReverseZones []string `json:"reverse_zones,omitempty"`
+
+	// DomainKeys holds the DNSSEC key basename for the domains in Domains
+	// and ReverseZones.
+	DomainKeys map[string]string `json:"dnssec_keys,omitempty"`
+
+	// DNSSEC key material, loaded from DNSSEC and DomainKeys.
+	key        *dnssecKey
+	domainKeys map[string]*dnssecKey
 }
 
 func LoadConfig(client *etcd.Client) (*Config, error) {
 	n, err := client.Get("/skydns/config", false, false)
-	config := &Config{ReadTimeout:0, WriteTimeout:0, Domain:"", DnsAddr:"", Nameservers:[]string{""},DNSSEC:""}
-	if err != nil {
-		return config, nil
-	}
-	if err := json.Unmarshal([]byte(n.Node.Value), &config); err != nil {
+	config := &Config{ReadTimeout: 0, WriteTimeout: 0, Domain: "", DnsAddr: "", DNSSEC: ""}
+	switch backendError(err) {
+	case nil:
+		if err := json.Unmarshal([]byte(n.Node.Value), &config); err != nil {
+			return nil, err
+		}
+	case ErrNotFound:
+		// No config, use the defaults.
+	default:
 		return nil, err
 	}
 	if err := setDefaults(config); err != nil {
@@ -47,6 +319,96 @@ func LoadConfig(client *etcd.Client) (*Config, error) {
 	return config, nil
 }
 
+// settings are the parts of the config that can be changed at runtime, see
+// watchConfig. Use server.settings to get the current ones.
+type settings struct {
+	ttl         uint32
+	minTtl      uint32
+	nameservers []string
+	roundRobin  bool
+	verbose     bool
+	static      map[string][]dns.RR
+
+	// Defaults for services that don't set these, only from zone overrides.
+	priority *int
+	weight   *int
+}
+
+func newSettings(config *Config) *settings {
+	return &settings{
+		ttl:         config.Ttl,
+		minTtl:      config.MinTtl,
+		nameservers: config.Nameservers,
+		roundRobin:  config.RoundRobin,
+		verbose:     config.Verbose,
+		static:      config.staticRecords,
+	}
+}
+
+// watchConfig watches /skydns/config and applies the settings that can be
+// changed at runtime: the TTLs, the nameservers, round robin, verbose
+// logging, the log limit, the DNSSEC key and the signature cache capacity.
+// Other changes need a restart. It blocks, so should be run in a goroutine.
+// It returns when the server stops.
+func (s *server) watchConfig() {
+	var index uint64
+	for {
+		r, err := s.client.Watch("/skydns/config", index, false, nil, s.stop)
+		if s.stopped() {
+			return
+		}
+		if err != nil {
+			log.Printf("error: Failure to watch config: %q", err)
+			index = 0
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		index = r.Node.ModifiedIndex + 1
+		config := new(Config)
+		if err := json.Unmarshal([]byte(r.Node.Value), config); err != nil {
+			log.Printf("error: Failure to parse config: %q", err)
+			continue
+		}
+		if err := setRuntimeDefaults(config); err != nil {
+			log.Printf("error: Failure to apply config: %q", err)
+			continue
+		}
+		if config.staticRecords, err = parseStaticRecords(config.StaticRecords, s.config); err != nil {
+			log.Printf("error: Failure to apply config: %q", err)
+			continue
+		}
+		s.setSettings(newSettings(config))
+		logger.setLimit(config.LogLimit)
+		s.reloadKey(config)
+		cache.setCapacity(config.SCache)
+		log.Printf("Config reloaded")
+	}
+}
+
+// setRuntimeDefaults sets the defaults for the settings that can be changed
+// at runtime.
+func setRuntimeDefaults(config *Config) error {
+	if config.Ttl == 0 {
+		config.Ttl = 3600
+	}
+	if config.MinTtl == 0 {
+		config.MinTtl = 60
+	}
+	if config.LogLimit == 0 {
+		config.LogLimit = 10
+	}
+	if len(config.Nameservers) == 0 {
+		c, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return err
+		}
+		for _, s := range c.Servers {
+			config.Nameservers = append(config.Nameservers, net.JoinHostPort(s, c.Port))
+		}
+	}
+	return nil
+}
+
 func setDefaults(config *Config) error {
 	if config.ReadTimeout == 0 {
 		config.ReadTimeout = 2 * time.Second
@@ -60,29 +422,255 @@ func setDefaults(config *Config) error {
 	if config.Domain == "" {
 		config.Domain = "skydns.local"
 	}
+	if config.Instance == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		config.Instance = strings.ToLower(h)
+	}
+	if err := setRuntimeDefaults(config); err != nil {
+		return err
+	}
+	if config.ListenRetries == 0 {
+		config.ListenRetries = 5
+	}
+	if config.QueryLogSample == 0 {
+		config.QueryLogSample = 1
+	}
+	if config.ApexSRVLimit == 0 {
+		config.ApexSRVLimit = 100
+	}
+	if config.MirrorSample == 0 {
+		config.MirrorSample = 1
+	}
+	if config.PostProcessTimeout == 0 {
+		config.PostProcessTimeout = 100 * time.Millisecond
+	}
 
-	if len(config.Nameservers) == 0 {
-		c, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if len(config.Geo) > 0 || config.GeoFile != "" {
+		g, err := newGeoTable(config.Geo, config.GeoFile)
 		if err != nil {
 			return err
 		}
-		for _, s := range c.Servers {
-			config.Nameservers = append(config.Nameservers, net.JoinHostPort(s, c.Port))
+		config.geo = g
+	}
+	if len(config.Hosts) > 0 {
+		h, err := newHosts(config.Hosts, dns.Fqdn(strings.ToLower(config.Domain)))
+		if err != nil {
+			return err
+		}
+		config.hosts = h
+	}
+	for i, z := range config.GeoZones {
+		config.GeoZones[i] = dns.Fqdn(strings.ToLower(z))
+	}
+	if config.TLSClientCA != "" && config.TLSCert == "" {
+		return fmt.Errorf("tls_client_ca needs tls_cert")
+	}
+	if config.AuthzURL != "" && len(config.HttpUsers) == 0 && config.TLSClientCA == "" {
+		return fmt.Errorf("authz_url needs http_users or tls_client_ca to authenticate clients")
+	}
+	switch config.Origin {
+	case "", "edns", "txt":
+	default:
+		return fmt.Errorf("origin must be \"edns\" or \"txt\", not %q", config.Origin)
+	}
+	switch config.CNAMEPolicy {
+	case "", "follow", "return", "reject":
+	default:
+		return fmt.Errorf("cname_policy must be \"follow\", \"return\" or \"reject\", not %q", config.CNAMEPolicy)
+	}
+	switch config.Truncate {
+	case "", "truncate", "drop-extra", "trim", "pad-to-advertised":
+	default:
+		return fmt.Errorf("truncate must be \"truncate\", \"drop-extra\", \"trim\" or \"pad-to-advertised\", not %q", config.Truncate)
+	}
+	if len(config.AllowedTypes) > 0 {
+		config.allowedTypes = make(map[uint16]bool)
+		for _, t := range config.AllowedTypes {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return fmt.Errorf("unknown type in allowed_types: %q", t)
+			}
+			config.allowedTypes[qtype] = true
+		}
+	}
+	var err error
+	if config.axfrAllow, err = newAcl(config.AxfrAllow); err != nil {
+		return err
+	}
+	if config.allowQuery, err = newAcl(config.AllowQuery); err != nil {
+		return err
+	}
+	if config.denyQuery, err = newAcl(config.DenyQuery); err != nil {
+		return err
+	}
+	if config.allowForward, err = newAcl(config.AllowForward); err != nil {
+		return err
+	}
+	if len(config.TsigSecret) > 0 {
+		secret := make(map[string]string)
+		for k, v := range config.TsigSecret {
+			secret[dns.Fqdn(strings.ToLower(k))] = v
+		}
+		config.TsigSecret = secret
+	}
+	if err := config.setDomains(append([]string{config.Domain}, config.Domains...)); err != nil {
+		return err
+	}
+	if config.staticRecords, err = parseStaticRecords(config.StaticRecords, config); err != nil {
+		return err
+	}
+	if config.Docker != "" {
+		if config.DockerDomain == "" {
+			config.DockerDomain = "docker." + config.Domain
+		}
+		config.DockerDomain = dns.Fqdn(strings.ToLower(config.DockerDomain))
+		// The subtree is cleared at startup, so it can't be the entire domain.
+		if !strings.HasSuffix(config.DockerDomain, "."+config.Domain) {
+			return fmt.Errorf("docker_domain must be below the SkyDNS domain")
+		}
+	}
+	if config.Marathon != "" {
+		if config.MarathonDomain == "" {
+			config.MarathonDomain = "marathon." + config.Domain
 		}
+		if config.MarathonInterval == 0 {
+			config.MarathonInterval = 10 * time.Second
+		}
+		config.MarathonDomain = dns.Fqdn(strings.ToLower(config.MarathonDomain))
+		if !strings.HasSuffix(config.MarathonDomain, "."+config.Domain) {
+			return fmt.Errorf("marathon_domain must be below the SkyDNS domain")
+		}
+	}
+	return nil
+}
+
+// setDomains sets the domains we are authoritative for, the first one becomes
+// Domain and the others, followed by ReverseZones, Domains, and loads their
+// DNSSEC keys.
+func (c *Config) setDomains(domains []string) error {
+	seen := make(map[string]bool)
+	var l []string
+	for _, d := range domains {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		d = dns.Fqdn(strings.ToLower(d))
+		if _, ok := dns.IsDomainName(d); !ok {
+			return fmt.Errorf("invalid domain: %q", d)
+		}
+		if !seen[d] {
+			seen[d] = true
+			l = append(l, d)
+		}
+	}
+	if len(l) == 0 {
+		return fmt.Errorf("no domain")
 	}
-	if config.DNSSEC != "" {
-		k, p, err := ParseKeyFile(config.DNSSEC)
+	for i, d := range c.ReverseZones {
+		d = dns.Fqdn(strings.ToLower(strings.TrimSpace(d)))
+		if !strings.HasSuffix(d, ".in-addr.arpa.") && !strings.HasSuffix(d, ".ip6.arpa.") {
+			return fmt.Errorf("reverse_zones: %q is not in in-addr.arpa. or ip6.arpa.", d)
+		}
+		c.ReverseZones[i] = d
+		if !seen[d] {
+			seen[d] = true
+			l = append(l, d)
+		}
+	}
+	c.Domain, c.Domains = l[0], l[1:]
+	c.DomainLabels = dns.CountLabel(c.Domain)
+
+	c.key = nil
+	if c.DNSSEC != "" {
+		k, err := loadKey(c.DNSSEC, c.Domain)
 		if err != nil {
 			return err
 		}
-		if k.Header().Name != dns.Fqdn(config.Domain) {
-			return fmt.Errorf("ownername of DNSKEY must match SkyDNS domain")
+		c.key = k
+	}
+	c.domainKeys = make(map[string]*dnssecKey)
+	for d, file := range c.DomainKeys {
+		d = dns.Fqdn(strings.ToLower(d))
+		if !seen[d] || d == c.Domain {
+			return fmt.Errorf("dnssec_keys: %q is not one of the other domains, use dnssec for %q", d, c.Domain)
+		}
+		k, err := loadKey(file, d)
+		if err != nil {
+			return err
+		}
+		c.domainKeys[d] = k
+	}
+	if c.NSEC3 {
+		keys := []*dnssecKey{c.key}
+		for _, k := range c.domainKeys {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if k != nil && k.pub.Algorithm == dns.RSASHA1 {
+				return fmt.Errorf("nsec3: key for %q uses RSASHA1, which can't be used with NSEC3", k.pub.Hdr.Name)
+			}
 		}
-		config.PubKey = k
-		config.KeyTag = k.KeyTag()
-		config.PrivKey = p
 	}
-	config.Domain = dns.Fqdn(strings.ToLower(config.Domain))
-	config.DomainLabels = dns.CountLabel(config.Domain)
 	return nil
 }
+
+// listenAddrs returns the addresses to listen on for net, "tcp" or "udp".
+func (c *Config) listenAddrs(net string) []string {
+	addrs := c.DnsAddr
+	switch {
+	case net == "tcp" && c.TCPAddr != "":
+		addrs = c.TCPAddr
+	case net == "udp" && c.UDPAddr != "":
+		addrs = c.UDPAddr
+	}
+	var l []string
+	for _, a := range strings.Split(addrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			l = append(l, a)
+		}
+	}
+	return l
+}
+
+// zoneOf returns the domain name is in, the longest one when domains are
+// nested, or "" when name is not in any of the domains.
+func (c *Config) zoneOf(name string) string {
+	name = strings.ToLower(name)
+	zone := ""
+	if dns.IsSubDomain(c.Domain, name) {
+		zone = c.Domain
+	}
+	for _, d := range c.Domains {
+		if len(d) > len(zone) && dns.IsSubDomain(d, name) {
+			zone = d
+		}
+	}
+	return zone
+}
+
+// parseStaticRecords parses the records in text format and returns them by
+// owner name. All names must be in one of the domains of zones.
+func parseStaticRecords(records []string, zones *Config) (map[string][]dns.RR, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+	static := make(map[string][]dns.RR)
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record in static_records: %q: %s", r, err)
+		}
+		if rr == nil {
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		if zones.zoneOf(name) == "" {
+			return nil, fmt.Errorf("record in static_records not in our domains: %q", r)
+		}
+		static[name] = append(static[name], rr)
+	}
+	return static, nil
+}
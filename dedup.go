@@ -0,0 +1,45 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import "github.com/miekg/dns"
+
+// dedup removes duplicate records from the answer, authority and additional
+// sections of m, a record is removed when the same section already has it.
+// Records that only differ in TTL are duplicates.
+func dedup(m *dns.Msg) {
+	buf := make([]byte, dns.DefaultMsgSize)
+	m.Answer = dedupRRs(m.Answer, buf)
+	m.Ns = dedupRRs(m.Ns, buf)
+	m.Extra = dedupRRs(m.Extra, buf)
+}
+
+// dedupRRs returns rrs without the duplicates, in a new slice. The records
+// themselves may be shared, i.e. the static records, so are not changed.
+func dedupRRs(rrs []dns.RR, buf []byte) []dns.RR {
+	seen := make(map[string]bool)
+	var ok []dns.RR
+	for _, r := range rrs {
+		if t := r.Header().Rrtype; t == dns.TypeOPT || t == dns.TypeTSIG {
+			ok = append(ok, r)
+			continue
+		}
+		// Compare the records in wire format, with the TTL of a copy set to 0.
+		// Records that do not fit in buf are kept.
+		c := dns.Copy(r)
+		c.Header().Ttl = 0
+		off, err := dns.PackRR(c, buf, 0, nil, false)
+		if err != nil {
+			ok = append(ok, r)
+			continue
+		}
+		if seen[string(buf[:off])] {
+			continue
+		}
+		seen[string(buf[:off])] = true
+		ok = append(ok, r)
+	}
+	return ok
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	pathpkg "path"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// delegationName returns the name delegated by serv, a service with NS set.
+// The nameservers of a delegated name are stored directly below it, i.e.
+// /skydns/local/skydns/child/ns1 for child.skydns.local.
+func delegationName(serv *Service) string {
+	return domain(pathpkg.Dir(serv.key))
+}
+
+// delegation returns the NS records and the glue for the delegation of
+// name, these are empty when name is not delegated.
+func (s *server) delegation(name string) (ns, glue []dns.RR) {
+	r, err := s.getName(name)
+	if err != nil || !r.Node.Dir {
+		return nil, nil
+	}
+	for _, n := range r.Node.Nodes {
+		if n.Dir {
+			continue
+		}
+		serv, err := s.newService(n)
+		if err != nil || !serv.NS || serv.Host == "" {
+			continue
+		}
+		ns = append(ns, s.delegationRecords(name, serv, &glue))
+	}
+	return ns, glue
+}
+
+// delegationRecords returns the NS record for the delegation serv of name,
+// when the Host of serv is an address, the glue is added to glue.
+func (s *server) delegationRecords(name string, serv *Service, glue *[]dns.RR) dns.RR {
+	ns := &dns.NS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: serv.ttl}, Ns: dns.Fqdn(serv.Host)}
+	ip := net.ParseIP(serv.Host)
+	switch {
+	case ip == nil:
+	case ip.To4() != nil:
+		ns.Ns = domain(serv.key)
+		*glue = append(*glue, &dns.A{Hdr: dns.RR_Header{Name: ns.Ns, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.ttl}, A: ip.To4()})
+	default:
+		ns.Ns = domain(serv.key)
+		*glue = append(*glue, &dns.AAAA{Hdr: dns.RR_Header{Name: ns.Ns, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.ttl}, AAAA: ip.To16()})
+	}
+	return ns
+}
+
+// referral turns m into a referral when the name queried in req is at or
+// below a delegated name in our zone. It returns false when it isn't. The
+// DS records of a delegated name are ours, so DS queries for it aren't
+// referred.
+func (s *server) referral(m, req *dns.Msg) bool {
+	name := strings.ToLower(req.Question[0].Name)
+	zone := s.zoneOf(name)
+	if req.Question[0].Qtype == dns.TypeDS && name != zone {
+		i, _ := dns.NextLabel(name, 0)
+		name = name[i:]
+	}
+	for name != zone {
+		if ns, glue := s.delegation(name); len(ns) > 0 {
+			m.Rcode = dns.RcodeSuccess
+			m.Authoritative = false
+			m.Answer = nil
+			m.Ns = ns
+			m.Extra = append(m.Extra, glue...)
+			return true
+		}
+		i, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[i:]
+	}
+	return false
+}
+
+// withoutDelegations returns sx without the services that are delegations,
+// these are not part of the answer for a name.
+func withoutDelegations(sx []*Service) []*Service {
+	ax := sx[:0]
+	for _, serv := range sx {
+		if !serv.NS {
+			ax = append(ax, serv)
+		}
+	}
+	return ax
+}
+
+// referralName returns the delegated name m refers to, or "" when m is not a
+// referral.
+func referralName(m *dns.Msg) string {
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0 || len(m.Ns) == 0 {
+		return ""
+	}
+	for _, r := range m.Ns {
+		if r.Header().Rrtype != dns.TypeNS {
+			return ""
+		}
+	}
+	return strings.ToLower(m.Ns[0].Header().Name)
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base32"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// apexTypes are the types of the records at the apex of our domains, when
+// these are denied with NSEC3.
+var apexTypes = []uint16{dns.TypeA, dns.TypeNS, dns.TypeSOA, dns.TypeAAAA, dns.TypeDNSKEY, dns.TypeNSEC3PARAM}
+
+// typesAt returns the types of the records at name (below the apex) as the
+// record functions find them, sorted. It is empty for an empty non-terminal:
+// a name that only exists because there are names below it, i.e. _tcp in
+// _http._tcp.web.skydns.local.
+func (s *server) typesAt(name, view string) []uint16 {
+	r, err := s.getName(name)
+	if err != nil {
+		return nil
+	}
+	sx, err := s.services(r, view)
+	if err != nil {
+		return nil
+	}
+	seen := make(map[uint16]bool)
+	for _, serv := range sx {
+		if serv.Host != "" {
+			seen[dns.TypeSRV] = true
+			if ip := net.ParseIP(serv.Host); ip != nil {
+				if ip.To4() != nil {
+					seen[dns.TypeA] = true
+				} else {
+					seen[dns.TypeAAAA] = true
+				}
+			}
+		}
+		if txt, err := serv.txt(); err == nil && len(txt) > 0 {
+			seen[dns.TypeTXT] = true
+		}
+		if serv.RR != "" {
+			if rr, err := dns.NewRR(serv.RR); err == nil && rr != nil {
+				seen[rr.Header().Rrtype] = true
+			}
+		}
+	}
+	if ns, _ := s.delegation(name); len(ns) > 0 {
+		seen[dns.TypeNS] = true
+	}
+	var types []uint16
+	for t := range seen {
+		types = append(types, t)
+	}
+	return sortTypes(types)
+}
+
+// nodataNSEC returns the NSEC record that proves qname has no records of the
+// queried type: owned by qname itself, listing the types it does have.
+func (s *server) nodataNSEC(qname, view string) *dns.NSEC {
+	qname = strings.ToLower(qname)
+	if qname == s.zoneOf(qname) {
+		return s.newNSEC(qname)
+	}
+	return &dns.NSEC{Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+		NextDomain: "\\000." + qname,
+		TypeBitMap: sortTypes(append(s.typesAt(qname, view), dns.TypeRRSIG, dns.TypeNSEC))}
+}
+
+// nsec3 adds the NSEC3 records that deny the name or type in the question to
+// m. These are white lies (RFC 7129): made up per query, covering only the
+// hash of the name they deny, so the zone can't be walked. We hash without
+// salt and extra iterations.
+//
+// For NXDOMAIN this is the closest encloser proof of RFC 5155, section 7.2.1.
+// For NODATA it is an NSEC3 matching qname, which has an empty type bitmap
+// when qname is an empty non-terminal (RFC 5155, section 7.2.3).
+func (s *server) nsec3(m *dns.Msg, view string) {
+	qname := strings.ToLower(m.Question[0].Name)
+	zone := s.zoneOf(qname)
+	if name := referralName(m); name != "" {
+		// There are no DS records for the delegation (RFC 5155, section 7.2.7),
+		// only the unsigned NS records.
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		m.Ns = append(m.Ns, newNSEC3(h, nextHash(h, 1), zone, []uint16{dns.TypeNS}))
+		return
+	}
+	if m.Rcode == dns.RcodeNameError {
+		ce := s.closestEncloser(qname, zone)
+		m.Ns = append(m.Ns, s.matchNSEC3(ce, zone, view), coverNSEC3(nextCloser(qname, ce), zone), coverNSEC3("*."+ce, zone))
+	}
+	if m.Rcode == dns.RcodeSuccess && len(m.Ns) == 1 {
+		if _, ok := m.Ns[0].(*dns.SOA); ok {
+			m.Ns = append(m.Ns, s.matchNSEC3(qname, zone, view))
+		}
+	}
+}
+
+// closestEncloser returns the longest existing ancestor of qname in zone.
+func (s *server) closestEncloser(qname, zone string) string {
+	for name := qname; name != zone && dns.IsSubDomain(zone, name); {
+		name = name[dns.Split(name)[1]:]
+		if name == zone {
+			break
+		}
+		if _, err := s.getName(name); err == nil {
+			return name
+		}
+	}
+	return zone
+}
+
+// nextCloser returns the name one label longer than the closest encloser ce
+// on the way to qname.
+func nextCloser(qname, ce string) string {
+	labels := dns.SplitDomainName(qname)
+	return dns.Fqdn(strings.Join(labels[len(labels)-dns.CountLabel(ce)-1:], "."))
+}
+
+// matchNSEC3 returns the NSEC3 record matching name, with the types at name.
+func (s *server) matchNSEC3(name, zone, view string) *dns.NSEC3 {
+	types := apexTypes
+	if name != zone {
+		types = s.typesAt(name, view)
+	}
+	if len(types) > 0 {
+		types = sortTypes(append(types[:len(types):len(types)], dns.TypeRRSIG))
+	}
+	h := dns.HashName(name, dns.SHA1, 0, "")
+	return newNSEC3(h, nextHash(h, 1), zone, types)
+}
+
+// NSEC3PARAM returns the NSEC3PARAM record of zone, with the parameters we
+// hash with (RFC 5155, section 4).
+func (s *server) NSEC3PARAM(zone string) dns.RR {
+	return &dns.NSEC3PARAM{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: s.settingsFor(zone).ttl},
+		Hash: dns.SHA1}
+}
+
+// coverNSEC3 returns an NSEC3 record that covers the hash of name.
+func coverNSEC3(name, zone string) *dns.NSEC3 {
+	h := dns.HashName(name, dns.SHA1, 0, "")
+	return newNSEC3(nextHash(h, -1), nextHash(h, 1), zone, nil)
+}
+
+func newNSEC3(owner, next, zone string, types []uint16) *dns.NSEC3 {
+	return &dns.NSEC3{Hdr: dns.RR_Header{Name: strings.ToLower(owner) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 60},
+		Hash: dns.SHA1, HashLength: 20, NextDomain: next, TypeBitMap: types}
+}
+
+// nextHash returns the hash (in base32hex, as returned by dns.HashName) that
+// comes d (1 or -1) after h.
+func nextHash(h string, d int) string {
+	b, err := base32.HexEncoding.DecodeString(strings.ToUpper(h))
+	if err != nil {
+		return h
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] += byte(d)
+		if (d > 0 && b[i] != 0) || (d < 0 && b[i] != 0xff) {
+			break
+		}
+	}
+	return base32.HexEncoding.EncodeToString(b)
+}
+
+// sortTypes sorts types, which is the order in which they are packed in a
+// type bitmap.
+func sortTypes(types []uint16) []uint16 {
+	sort.Sort(uint16s(types))
+	return types
+}
+
+type uint16s []uint16
+
+func (u uint16s) Len() int           { return len(u) }
+func (u uint16s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint16s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
@@ -0,0 +1,153 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var denialServices = map[string]string{
+	"/skydns/local/skydns/web/_tcp/_http/1": `{"Host":"10.0.0.1","Port":80}`,
+	"/skydns/local/skydns/web/1":            `{"Host":"10.0.0.2","Port":80}`,
+}
+
+// hashLabel returns the first label of the owner name of an NSEC3 record.
+func hashLabel(rr dns.RR) string {
+	return strings.ToUpper(rr.Header().Name[:strings.Index(rr.Header().Name, ".")])
+}
+
+// covers returns true when the NSEC3 record n covers the hash of name.
+func covers(n *dns.NSEC3, name string) bool {
+	h := dns.HashName(name, dns.SHA1, 0, "")
+	return hashLabel(n) < h && h < n.NextDomain
+}
+
+// matches returns true when the NSEC3 record n matches name.
+func matches(n *dns.NSEC3, name string) bool {
+	return hashLabel(n) == dns.HashName(name, dns.SHA1, 0, "")
+}
+
+func query(s *server, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	w := &dohWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+	s.ServeDNS(w, req)
+	return w.msg
+}
+
+func TestNodataEmptyNonTerminal(t *testing.T) {
+	s := newZoneServer(t, &Config{Nameservers: []string{"127.0.0.1:53"}, NSEC3: true}, denialServices)
+	for _, nsec3 := range []bool{false, true} {
+		s.config.NSEC3 = nsec3
+		m := query(s, "_tcp.web.skydns.local.", dns.TypeSRV)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+			t.Fatalf("expected NODATA for an empty non-terminal, got %s with %d answers", dns.RcodeToString[m.Rcode], len(m.Answer))
+		}
+		s.nsec(m, "")
+		if len(m.Ns) != 2 {
+			t.Fatalf("expected SOA and NSEC(3), got %v", m.Ns)
+		}
+		switch n := m.Ns[1].(type) {
+		case *dns.NSEC:
+			if nsec3 || n.Hdr.Name != "_tcp.web.skydns.local." || !sameTypes(n.TypeBitMap, []uint16{dns.TypeRRSIG, dns.TypeNSEC}) {
+				t.Errorf("expected NSEC for _tcp.web.skydns.local. with only RRSIG and NSEC, got %s", n)
+			}
+		case *dns.NSEC3:
+			if !nsec3 || !matches(n, "_tcp.web.skydns.local.") || len(n.TypeBitMap) != 0 {
+				t.Errorf("expected NSEC3 matching _tcp.web.skydns.local. with an empty bitmap, got %s", n)
+			}
+		default:
+			t.Errorf("expected NSEC(3), got %s", n)
+		}
+	}
+}
+
+func TestNodataNSEC3(t *testing.T) {
+	s := newZoneServer(t, &Config{Nameservers: []string{"127.0.0.1:53"}, NSEC3: true}, denialServices)
+	m := query(s, "web.skydns.local.", dns.TypeTXT)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("expected NODATA, got %s with %d answers", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	s.nsec(m, "")
+	n, ok := m.Ns[len(m.Ns)-1].(*dns.NSEC3)
+	if !ok || !matches(n, "web.skydns.local.") {
+		t.Fatalf("expected NSEC3 matching web.skydns.local., got %v", m.Ns)
+	}
+	if !sameTypes(n.TypeBitMap, []uint16{dns.TypeA, dns.TypeSRV, dns.TypeRRSIG}) {
+		t.Errorf("expected A, SRV and RRSIG in the bitmap, got %v", n.TypeBitMap)
+	}
+}
+
+func TestNXDomainNSEC3(t *testing.T) {
+	s := newZoneServer(t, &Config{Nameservers: []string{"127.0.0.1:53"}, NSEC3: true}, denialServices)
+	tests := []struct {
+		qname, ce string
+	}{
+		{"nope.web.skydns.local.", "web.skydns.local."},
+		{"a.b.web.skydns.local.", "web.skydns.local."},
+		{"nope.skydns.local.", "skydns.local."},
+		{"a.nope._tcp.web.skydns.local.", "_tcp.web.skydns.local."},
+	}
+	for _, tc := range tests {
+		m := query(s, tc.qname, dns.TypeA)
+		if m.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: expected NXDOMAIN, got %s", tc.qname, dns.RcodeToString[m.Rcode])
+			continue
+		}
+		s.nsec(m, "")
+		var nsec3 []*dns.NSEC3
+		for _, r := range m.Ns {
+			if n, ok := r.(*dns.NSEC3); ok {
+				nsec3 = append(nsec3, n)
+			}
+		}
+		if len(nsec3) != 3 {
+			t.Errorf("%s: expected 3 NSEC3 records, got %v", tc.qname, m.Ns)
+			continue
+		}
+		if !matches(nsec3[0], tc.ce) {
+			t.Errorf("%s: expected NSEC3 matching the closest encloser %s, got %s", tc.qname, tc.ce, nsec3[0])
+		}
+		if nc := nextCloser(tc.qname, tc.ce); !covers(nsec3[1], nc) {
+			t.Errorf("%s: expected NSEC3 covering the next closer name %s, got %s", tc.qname, nc, nsec3[1])
+		}
+		if !covers(nsec3[2], "*."+tc.ce) {
+			t.Errorf("%s: expected NSEC3 covering *.%s, got %s", tc.qname, tc.ce, nsec3[2])
+		}
+		if tc.ce == "skydns.local." && !sameTypes(nsec3[0].TypeBitMap, sortTypes(append(apexTypes[:len(apexTypes):len(apexTypes)], dns.TypeRRSIG))) {
+			t.Errorf("%s: expected the apex types in the bitmap, got %v", tc.qname, nsec3[0].TypeBitMap)
+		}
+	}
+}
+
+func TestNSEC3PARAM(t *testing.T) {
+	s := newZoneServer(t, &Config{StaticNS: []string{"192.0.2.1"}, NSEC3: true}, nil)
+	q := dns.Question{Name: "skydns.local.", Qtype: dns.TypeNSEC3PARAM, Qclass: dns.ClassINET}
+	m := new(dns.Msg)
+	if err := s.apex(m, q, &dnssecKey{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answer) != 1 {
+		t.Fatalf("expected an NSEC3PARAM record, got %v", m.Answer)
+	}
+	p, ok := m.Answer[0].(*dns.NSEC3PARAM)
+	if !ok || p.Hash != dns.SHA1 || p.Iterations != 0 || p.Salt != "" {
+		t.Errorf("expected NSEC3PARAM for SHA1 without salt and iterations, got %s", m.Answer[0])
+	}
+	found := false
+	for _, typ := range apexTypes {
+		found = found || typ == dns.TypeNSEC3PARAM
+	}
+	if !found {
+		t.Errorf("NSEC3PARAM not in apexTypes")
+	}
+	if !sameTypes(apexTypes, sortTypes(append([]uint16{}, apexTypes...))) {
+		t.Errorf("apexTypes not sorted: %v", apexTypes)
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"crypto/sha1"
+	"fmt"
 	"log"
 	"os"
 	"sync"
@@ -44,8 +45,112 @@ func ParseKeyFile(file string) (*dns.DNSKEY, dns.PrivateKey, error) {
 	return k.(*dns.DNSKEY), p, nil
 }
 
-// nsec creates (if needed) NSEC records that are included in the reply.
-func (s *server) nsec(m *dns.Msg) {
+// dnssecKey is the DNSSEC key material, it is replaced as a whole when the
+// key changes.
+type dnssecKey struct {
+	file string // basename of the key files
+	pub  *dns.DNSKEY
+	tag  uint16
+	priv dns.PrivateKey
+}
+
+// key returns the current DNSSEC key, or nil when DNSSEC is disabled.
+func (s *server) key() *dnssecKey {
+	s.keyLock.RLock()
+	defer s.keyLock.RUnlock()
+	return s.dnskey
+}
+
+// setKey replaces the DNSSEC key with k, a nil k disables DNSSEC. Cached
+// signatures are made with the old key, so these are thrown away.
+func (s *server) setKey(k *dnssecKey) {
+	s.keyLock.Lock()
+	s.dnskey = k
+	s.keyLock.Unlock()
+	cache.flush()
+}
+
+// reloadKey loads the DNSSEC key from config when its basename differs from
+// the current one, so keys can be rolled without a restart.
+func (s *server) reloadKey(config *Config) {
+	var file string
+	if k := s.key(); k != nil {
+		file = k.file
+	}
+	if config.DNSSEC == file {
+		return
+	}
+	if config.DNSSEC == "" {
+		log.Printf("DNSSEC disabled")
+		s.setKey(nil)
+		return
+	}
+	k, err := loadKey(config.DNSSEC, s.config.Domain)
+	if err != nil {
+		log.Printf("error: Failure to load DNSSEC key %q: %q", config.DNSSEC, err)
+		return
+	}
+	log.Printf("DNSSEC key %q loaded, keytag %d", config.DNSSEC, k.tag)
+	s.setKey(k)
+}
+
+// signingAlgorithms are the DNSSEC algorithms we sign with.
+var signingAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+}
+
+// loadKey loads the DNSSEC key from file and checks that we can sign with
+// it: the ownername of the key must be domain, the algorithm must be one we
+// support, it must be a zone key and a signature made with it must verify.
+func loadKey(file, domain string) (*dnssecKey, error) {
+	k, p, err := ParseKeyFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if k.Header().Name != dns.Fqdn(domain) {
+		return nil, fmt.Errorf("ownername of DNSKEY %q must match SkyDNS domain %q", k.Header().Name, dns.Fqdn(domain))
+	}
+	if !signingAlgorithms[k.Algorithm] {
+		return nil, fmt.Errorf("DNSKEY algorithm %s is not supported, use RSASHA256 or ECDSAP256SHA256", dns.AlgorithmToString[k.Algorithm])
+	}
+	if k.Flags&dns.ZONE == 0 {
+		return nil, fmt.Errorf("DNSKEY is not a zone key (flags %d), generate one without -n HOST or -n USER", k.Flags)
+	}
+	if k.Flags&dns.SEP == dns.SEP {
+		log.Printf("DNSKEY %q with keytag %d is a KSK, answers are signed with it as there is no separate ZSK", file, k.KeyTag())
+	}
+	key := &dnssecKey{file: file, pub: k, tag: k.KeyTag(), priv: p}
+	// Self test, sign the DNSKEY and verify the signature.
+	now := time.Now().UTC()
+	sig := newRRSIG(key, uint32(now.Add(-time.Hour).Unix()), uint32(now.Add(time.Hour).Unix()))
+	if err := sig.Sign(p, []dns.RR{k}); err != nil {
+		return nil, fmt.Errorf("failure to sign with DNSKEY: %s, does the private key match?", err)
+	}
+	if err := sig.Verify(k, []dns.RR{k}); err != nil {
+		return nil, fmt.Errorf("failure to verify signature made with DNSKEY: %s, the private key does not match the public key", err)
+	}
+	return key, nil
+}
+
+// nsec creates (if needed) NSEC records that are included in the reply, or
+// NSEC3 records with NSEC3 set in the config. View is used to find the types
+// at a name for NODATA replies.
+func (s *server) nsec(m *dns.Msg, view string) {
+	if s.config.NSEC3 {
+		s.nsec3(m, view)
+		return
+	}
+	if name := referralName(m); name != "" {
+		// There are no DS records for the delegation (RFC 4035, section 3.1.4.1).
+		m.Ns = append(m.Ns, &dns.NSEC{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+			NextDomain: "\\000." + name, TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}})
+		return
+	}
 	if m.Rcode == dns.RcodeNameError {
 		// qname nsec
 		nsec1 := s.newNSEC(m.Question[0].Name)
@@ -61,7 +166,7 @@ func (s *server) nsec(m *dns.Msg) {
 	}
 	if m.Rcode == dns.RcodeSuccess && len(m.Ns) == 1 {
 		if _, ok := m.Ns[0].(*dns.SOA); ok {
-			m.Ns = append(m.Ns, s.newNSEC(m.Question[0].Name))
+			m.Ns = append(m.Ns, s.nodataNSEC(m.Question[0].Name, view))
 		}
 	}
 }
@@ -72,7 +177,7 @@ func (s *server) nsec(m *dns.Msg) {
 // We also fake the origin TTL in the signature, because we don't want to
 // throw away signatures when services decide to have longer TTL. So we just
 // set the origTTL to 60.
-func (s *server) sign(m *dns.Msg, bufsize uint16) {
+func (s *server) sign(m *dns.Msg, bufsize uint16, k *dnssecKey) {
 	now := time.Now().UTC()
 	incep := uint32(now.Add(-2 * time.Hour).Unix())     // 2 hours, be sure to catch daylight saving time and such
 	expir := uint32(now.Add(7 * 24 * time.Hour).Unix()) // sign for a week
@@ -91,10 +196,10 @@ func (s *server) sign(m *dns.Msg, bufsize uint16) {
 			cache.remove(key)
 		}
 		sig, err, shared := inflight.Do(key, func() (*dns.RRSIG, error) {
-			sig1 := s.newRRSIG(incep, expir)
-			e := sig1.Sign(s.config.PrivKey, r)
+			sig1 := newRRSIG(k, incep, expir)
+			e := sig1.Sign(k.priv, r)
 			if e != nil {
-				log.Printf("Failed to sign: %s\n", e.Error())
+				logf("error: Failure to sign: %q", e)
 			}
 			return sig1, e
 		})
@@ -111,6 +216,10 @@ func (s *server) sign(m *dns.Msg, bufsize uint16) {
 		if r[0].Header().Rrtype == dns.TypeRRSIG {
 			continue
 		}
+		if r[0].Header().Rrtype == dns.TypeNS && r[0].Header().Name != k.pub.Hdr.Name {
+			// The NS records of a delegation are not signed (RFC 4035, section 3.1.4).
+			continue
+		}
 		key := cache.key(r)
 		if s := cache.search(key); s != nil {
 			if s.ValidityPeriod(now.Add(-24 * time.Hour)) {
@@ -120,10 +229,10 @@ func (s *server) sign(m *dns.Msg, bufsize uint16) {
 			cache.remove(key)
 		}
 		sig, err, shared := inflight.Do(key, func() (*dns.RRSIG, error) {
-			sig1 := s.newRRSIG(incep, expir)
-			e := sig1.Sign(s.config.PrivKey, r)
+			sig1 := newRRSIG(k, incep, expir)
+			e := sig1.Sign(k.priv, r)
 			if e != nil {
-				log.Printf("Failed to sign: %s\n", e.Error())
+				logf("error: Failure to sign: %q", e)
 			}
 			return sig1, e
 		})
@@ -137,9 +246,6 @@ func (s *server) sign(m *dns.Msg, bufsize uint16) {
 		m.Ns = append(m.Ns, dns.Copy(sig).(*dns.RRSIG))
 	}
 	// TODO(miek): Forget the additional section for now
-	if bufsize >= 512 || bufsize <= 4096 {
-		m.Truncated = m.Len() > int(bufsize)
-	}
 	o := new(dns.OPT)
 	o.Hdr.Name = "."
 	o.Hdr.Rrtype = dns.TypeOPT
@@ -149,28 +255,29 @@ func (s *server) sign(m *dns.Msg, bufsize uint16) {
 	return
 }
 
-func (s *server) newRRSIG(incep, expir uint32) *dns.RRSIG {
+func newRRSIG(k *dnssecKey, incep, expir uint32) *dns.RRSIG {
 	sig := new(dns.RRSIG)
 	sig.Hdr.Rrtype = dns.TypeRRSIG
 	sig.Hdr.Ttl = origTTL
 	sig.OrigTtl = origTTL
-	sig.Algorithm = s.config.PubKey.Algorithm
-	sig.KeyTag = s.config.KeyTag
+	sig.Algorithm = k.pub.Algorithm
+	sig.KeyTag = k.tag
 	sig.Inception = incep
 	sig.Expiration = expir
-	sig.SignerName = s.config.PubKey.Hdr.Name
+	sig.SignerName = k.pub.Hdr.Name
 	return sig
 }
 
 // newNSEC returns the NSEC record need to denial qname, or gives back a NODATA NSEC.
 func (s *server) newNSEC(qname string) *dns.NSEC {
+	zone := s.zoneOf(qname)
 	qlabels := dns.SplitDomainName(qname)
-	if len(qlabels) < s.domainLabels {
+	if len(qlabels) < dns.CountLabel(zone) {
 		// TODO(miek): can not happen...?
 	}
-	// Strip the last s.domainLabels, return up to 4 before
+	// Strip the labels of the zone, return up to 4 before
 	// that. Four labels is the maximum qname we can handle.
-	ls := len(qlabels) - s.domainLabels
+	ls := len(qlabels) - dns.CountLabel(zone)
 	ls4 := ls - 4
 	if ls4 < 0 {
 		ls4 = 0
@@ -180,12 +287,12 @@ func (s *server) newNSEC(qname string) *dns.NSEC {
 	// TODO etcd here
 	//	prev, next := s.registry.GetNSEC(strings.Join(key, "."))
 	prev, next := "", ""
-	nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: prev + s.config.Domain + ".", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
-		NextDomain: next + s.config.Domain + "."}
+	nsec := &dns.NSEC{Hdr: dns.RR_Header{Name: prev + zone, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+		NextDomain: next + zone}
 	if prev == "" {
 		nsec.TypeBitMap = []uint16{dns.TypeA, dns.TypeSOA, dns.TypeNS, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}
 	} else {
-		nsec.TypeBitMap = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeRRSIG, dns.TypeNSEC}
+		nsec.TypeBitMap = []uint16{dns.TypeA, dns.TypeTXT, dns.TypeAAAA, dns.TypeSRV, dns.TypeRRSIG, dns.TypeNSEC}
 	}
 	return nsec
 }
@@ -213,33 +320,108 @@ func rrSets(rrs []dns.RR) map[rrset][]dns.RR {
 	return nil
 }
 
+// sigCacheShards is the number of shards in the signature cache, each with
+// its own lock, to keep lock contention down.
+const sigCacheShards = 32
+
+// sigCache caches signatures, keyed by a hash of the signed RRset. When the
+// capacity is not zero, a shard that is full drops an arbitrary signature
+// before inserting a new one.
 type sigCache struct {
+	shards [sigCacheShards]*sigShard
+}
+
+type sigShard struct {
 	sync.RWMutex
-	m map[string]*dns.RRSIG
+	m        map[string]*dns.RRSIG
+	capacity int
 }
 
 func newCache() *sigCache {
 	c := new(sigCache)
-	c.m = make(map[string]*dns.RRSIG)
+	for i := range c.shards {
+		c.shards[i] = &sigShard{m: make(map[string]*dns.RRSIG)}
+	}
 	return c
 }
 
+// shard returns the shard for key s, using FNV-1a.
+func (c *sigCache) shard(s string) *sigShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return c.shards[h%sigCacheShards]
+}
+
 func (c *sigCache) remove(s string) {
-	delete(c.m, s)
+	sh := c.shard(s)
+	sh.Lock()
+	defer sh.Unlock()
+	delete(sh.m, s)
+}
+
+// setCapacity sets the maximum number of signatures in the cache, 0 means
+// no limit. Lowering the capacity drops signatures until they fit.
+func (c *sigCache) setCapacity(n int) {
+	per := 0
+	if n > 0 {
+		per = (n + sigCacheShards - 1) / sigCacheShards
+	}
+	for _, sh := range c.shards {
+		sh.Lock()
+		sh.capacity = per
+		for k := range sh.m {
+			if per == 0 || len(sh.m) <= per {
+				break
+			}
+			delete(sh.m, k)
+		}
+		sh.Unlock()
+	}
+}
+
+// len returns the number of signatures in the cache.
+func (c *sigCache) len() (n int) {
+	for _, sh := range c.shards {
+		sh.RLock()
+		n += len(sh.m)
+		sh.RUnlock()
+	}
+	return n
+}
+
+// flush removes all signatures from the cache.
+func (c *sigCache) flush() {
+	for _, sh := range c.shards {
+		sh.Lock()
+		sh.m = make(map[string]*dns.RRSIG)
+		sh.Unlock()
+	}
 }
 
 func (c *sigCache) insert(s string, r *dns.RRSIG) {
-	c.Lock()
-	defer c.Unlock()
-	if _, ok := c.m[s]; !ok {
-		c.m[s] = r
+	sh := c.shard(s)
+	sh.Lock()
+	defer sh.Unlock()
+	if _, ok := sh.m[s]; ok {
+		return
+	}
+	if sh.capacity > 0 && len(sh.m) >= sh.capacity {
+		for k := range sh.m {
+			delete(sh.m, k)
+			break
+		}
 	}
+	sh.m[s] = r
 }
 
 func (c *sigCache) search(s string) *dns.RRSIG {
-	c.RLock()
-	defer c.RUnlock()
-	if s, ok := c.m[s]; ok {
+	sh := c.shard(s)
+	sh.RLock()
+	defer sh.RUnlock()
+	if s, ok := sh.m[s]; ok {
 		// we want to return a copy here, because if we didn't the RRSIG
 		// could be removed by another goroutine before the packet containing
 		// this signature is send out.
@@ -269,13 +451,22 @@ func (c *sigCache) key(rrs []dns.RR) string {
 			i = append(i, []byte(t.A)...)
 		case *dns.AAAA:
 			i = append(i, []byte(t.AAAA)...)
+		case *dns.NS:
+			i = append(i, []byte(t.Ns)...)
+		case *dns.TXT:
+			for _, t1 := range t.Txt {
+				i = append(i, []byte(t1)...)
+			}
 		case *dns.DNSKEY:
 			// Need nothing more, the rdata stays the same during a run
 		case *dns.NSEC:
 			i = append(i, []byte(t.NextDomain)...)
-			// bitmap does not differentiate
+			for _, b := range t.TypeBitMap {
+				i = append(i, packUint16(b)...)
+			}
 		default:
-			log.Printf("DNS Signature for unhandled type %T seen", t)
+			// I.e. records from the rr field of a service.
+			i = append(i, []byte(t.String())...)
 		}
 	}
 	return string(h.Sum(i))
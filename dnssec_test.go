@@ -0,0 +1,133 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// lockedCache is the signature cache as it was before it was sharded: one
+// map behind one lock. It is here to compare the sharded cache against, run
+// the benchmarks with i.e. -cpu 1,4,16 to see the difference.
+type lockedCache struct {
+	sync.RWMutex
+	m map[string]*dns.RRSIG
+}
+
+func (c *lockedCache) insert(s string, r *dns.RRSIG) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.m[s]; ok {
+		return
+	}
+	c.m[s] = r
+}
+
+func (c *lockedCache) search(s string) *dns.RRSIG {
+	c.RLock()
+	defer c.RUnlock()
+	if s, ok := c.m[s]; ok {
+		log.Println("DNS Signature retrieved from cache")
+		return dns.Copy(s).(*dns.RRSIG)
+	}
+	return nil
+}
+
+// benchKeys returns n cache keys of RRsets as the server makes them.
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		a, _ := dns.NewRR("web" + strconv.Itoa(i) + ".skydns.local. 3600 IN A 10.0.0.1")
+		keys[i] = cache.key([]dns.RR{a})
+	}
+	return keys
+}
+
+func benchSig() *dns.RRSIG {
+	return &dns.RRSIG{Hdr: dns.RR_Header{Name: "skydns.local.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		TypeCovered: dns.TypeA, Algorithm: dns.RSASHA256, SignerName: "skydns.local.", Signature: "c2lnbmF0dXJl"}
+}
+
+// quiet silences the log line search prints for every hit.
+func quiet(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	b.ResetTimer()
+}
+
+func BenchmarkSigCacheKey(b *testing.B) {
+	a, _ := dns.NewRR("web.skydns.local. 3600 IN A 10.0.0.1")
+	rrs := []dns.RR{a}
+	for i := 0; i < b.N; i++ {
+		cache.key(rrs)
+	}
+}
+
+func BenchmarkSigCacheInsertParallel(b *testing.B) {
+	c := newCache()
+	keys := benchKeys(1024)
+	sig := benchSig()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.insert(keys[i%len(keys)], sig)
+		}
+	})
+}
+
+func BenchmarkLockedCacheInsertParallel(b *testing.B) {
+	c := &lockedCache{m: make(map[string]*dns.RRSIG)}
+	keys := benchKeys(1024)
+	sig := benchSig()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.insert(keys[i%len(keys)], sig)
+		}
+	})
+}
+
+// The mix of the server: mostly hits, a miss (and insert) now and then.
+func BenchmarkSigCacheMixedParallel(b *testing.B) {
+	defer log.SetOutput(os.Stderr)
+	c := newCache()
+	keys := benchKeys(1024)
+	sig := benchSig()
+	for _, k := range keys[:len(keys)/2] {
+		c.insert(k, sig)
+	}
+	quiet(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			k := keys[i%len(keys)]
+			if c.search(k) == nil {
+				c.insert(k, sig)
+			}
+		}
+	})
+}
+
+func BenchmarkLockedCacheMixedParallel(b *testing.B) {
+	defer log.SetOutput(os.Stderr)
+	c := &lockedCache{m: make(map[string]*dns.RRSIG)}
+	keys := benchKeys(1024)
+	sig := benchSig()
+	for _, k := range keys[:len(keys)/2] {
+		c.insert(k, sig)
+	}
+	quiet(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			k := keys[i%len(keys)]
+			if c.search(k) == nil {
+				c.insert(k, sig)
+			}
+		}
+	})
+}
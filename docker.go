@@ -0,0 +1,209 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dockerSync registers the running Docker containers as services under
+// DockerDomain, the name of the container is used as the name of the
+// service. It listens to the events of the Docker daemon to register
+// started containers and remove stopped ones. The subtree under
+// DockerDomain is owned by dockerSync, it is cleared at startup.
+type dockerSync struct {
+	sync.Mutex
+	s      *server
+	client *http.Client
+	domain string
+	keys   map[string]string // container ID to etcd key
+}
+
+// dockerContainer is the part of the container inspect result we use.
+type dockerContainer struct {
+	ID     string `json:"Id"`
+	Name   string
+	Config struct {
+		ExposedPorts map[string]struct{}
+	}
+	NetworkSettings struct {
+		IPAddress string
+	}
+}
+
+// dockerEvent is a single event from the /events stream.
+type dockerEvent struct {
+	Status string `json:"status"`
+	ID     string `json:"id"`
+}
+
+func newDockerSync(s *server) *dockerSync {
+	sock := s.config.Docker
+	tr := &http.Transport{Dial: func(network, addr string) (net.Conn, error) {
+		return net.Dial("unix", sock)
+	}}
+	return &dockerSync{s: s, client: &http.Client{Transport: tr}, domain: s.config.DockerDomain, keys: make(map[string]string)}
+}
+
+// run syncs the containers and then follows the events. It blocks, so
+// should be run in a goroutine. It returns when the server stops.
+func (d *dockerSync) run() {
+	if _, err := d.s.client.Delete(path(d.domain), true); err != nil && backendError(err) != ErrNotFound {
+		log.Printf("error: Failure to clear %q: %q", d.domain, err)
+	}
+	for {
+		if err := d.sync(); err != nil {
+			log.Printf("error: Failure to sync Docker containers: %q", err)
+			select {
+			case <-d.s.stop:
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		err := d.events()
+		if d.s.stopped() {
+			return
+		}
+		log.Printf("error: Failure to get Docker events: %q", err)
+		select {
+		case <-d.s.stop:
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// sync registers all running containers.
+func (d *dockerSync) sync() error {
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	if err := d.get("/containers/json", &list); err != nil {
+		return err
+	}
+	for _, c := range list {
+		d.add(c.ID)
+	}
+	return nil
+}
+
+// events follows the Docker event stream until it fails or the server stops.
+func (d *dockerSync) events() error {
+	resp, err := d.client.Get("http://docker/events")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Closing the body ends the stream when the server stops.
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-d.s.stop:
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e dockerEvent
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		switch e.Status {
+		case "start", "unpause":
+			d.add(e.ID)
+		case "die", "stop", "kill", "pause", "destroy":
+			d.remove(e.ID)
+		}
+	}
+}
+
+// add registers the container with id.
+func (d *dockerSync) add(id string) {
+	var c dockerContainer
+	if err := d.get("/containers/"+id+"/json", &c); err != nil {
+		log.Printf("error: Failure to inspect container %q: %q", id, err)
+		return
+	}
+	name := strings.ToLower(strings.TrimPrefix(c.Name, "/"))
+	if c.NetworkSettings.IPAddress == "" || name == "" {
+		return
+	}
+	if _, ok := dns.IsDomainName(name + "." + d.domain); !ok {
+		log.Printf("error: Container name %q is not a valid domain name", name)
+		return
+	}
+	serv := &Service{Host: c.NetworkSettings.IPAddress, Port: lowestPort(c.Config.ExposedPorts)}
+	value, err := json.Marshal(serv)
+	if err != nil {
+		return
+	}
+	key := path(name + "." + d.domain)
+	if _, err := d.s.client.Set(key, string(value), 0); err != nil {
+		log.Printf("error: Failure to register container %q: %q", name, err)
+		return
+	}
+	d.Lock()
+	d.keys[c.ID] = key
+	d.Unlock()
+	log.Printf("Registered container %q at %q", name, key)
+}
+
+// remove removes the container with id.
+func (d *dockerSync) remove(id string) {
+	d.Lock()
+	key, ok := d.keys[id]
+	delete(d.keys, id)
+	d.Unlock()
+	if !ok {
+		return
+	}
+	if _, err := d.s.client.Delete(key, false); err != nil && backendError(err) != ErrNotFound {
+		log.Printf("error: Failure to remove container at %q: %q", key, err)
+		return
+	}
+	log.Printf("Removed container at %q", key)
+}
+
+// get does a GET of path on the Docker API and decodes the JSON reply in v.
+func (d *dockerSync) get(path string, v interface{}) error {
+	resp, err := d.client.Get("http://docker" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// lowestPort returns the lowest of the exposed ports ("80/tcp"), or 0.
+func lowestPort(exposed map[string]struct{}) int {
+	var ports []int
+	for p := range exposed {
+		if n, err := strconv.Atoi(strings.SplitN(p, "/", 2)[0]); err == nil {
+			ports = append(ports, n)
+		}
+	}
+	if len(ports) == 0 {
+		return 0
+	}
+	sort.Ints(ports)
+	return ports[0]
+}
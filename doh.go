@@ -0,0 +1,237 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const mimeDNSMessage = "application/dns-message"
+
+// dohWriter implements dns.ResponseWriter and captures the reply, so we
+// can use ServeDNS for DNS over HTTPS requests.
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr       { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *dohWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *dohWriter) Close() error              { return nil }
+func (w *dohWriter) TsigStatus() error         { return dns.ErrAuth } // TSIG isn't verified here
+func (w *dohWriter) TsigTimersOnly(bool)       {}
+func (w *dohWriter) Hijack()                   {}
+func (w *dohWriter) Write(b []byte) (int, error) {
+	w.msg = new(dns.Msg)
+	if err := w.msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func newDohWriter(req *http.Request) *dohWriter {
+	w := &dohWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+	if h, p, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		port, _ := strconv.Atoi(p)
+		w.remote = &net.TCPAddr{IP: net.ParseIP(h), Port: port}
+	}
+	return w
+}
+
+// ServeDoH implements DNS over HTTPS as described in RFC 8484.
+func (s *server) ServeDoH(w http.ResponseWriter, req *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+	switch req.Method {
+	case "GET":
+		buf, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case "POST":
+		if req.Header.Get("Content-Type") != mimeDNSMessage {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The message ID should be 0 for cache friendliness, we use whatever the
+	// client gave us and hand it back.
+	dw := newDohWriter(req)
+	s.ServeDNS(dw, m)
+	if dw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	out, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mimeDNSMessage)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTtl(dw.msg))))
+	w.Write(out)
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonMsg struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRR       `json:"Answer,omitempty"`
+	Authority []jsonRR       `json:"Authority,omitempty"`
+}
+
+// ServeDoHJSON implements the JSON flavor of DNS over HTTPS, queries look
+// like /resolve?name=web.skydns.local&type=A.
+func (s *server) ServeDoHJSON(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+	qtype, ok := parseType(req.URL.Query().Get("type"))
+	if !ok {
+		http.Error(w, "invalid type", http.StatusBadRequest)
+		return
+	}
+	cd := req.URL.Query().Get("cd") == "1" || req.URL.Query().Get("cd") == "true"
+	j := s.queryJSON(req, name, qtype, cd)
+	if j == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-json")
+	json.NewEncoder(w).Encode(j)
+}
+
+// maxBulk is the maximum number of queries in a single bulk request.
+const maxBulk = 1000
+
+// ServeBulk answers a list of queries in one go. The body of the POST is a
+// JSON list of queries: [{"name":"web.skydns.local","type":"A"}, ...], the
+// answers are returned in the same order in the format used by /resolve.
+func (s *server) ServeBulk(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var queries []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&queries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(queries) > maxBulk {
+		http.Error(w, "too many queries", http.StatusRequestEntityTooLarge)
+		return
+	}
+	answers := make([]*jsonMsg, len(queries))
+	for i, q := range queries {
+		qtype, ok := parseType(q.Type)
+		if _, ok1 := dns.IsDomainName(q.Name); !ok || !ok1 || q.Name == "" {
+			answers[i] = &jsonMsg{Status: dns.RcodeFormatError, Question: []jsonQuestion{{Name: q.Name, Type: qtype}}}
+			continue
+		}
+		answers[i] = s.queryJSON(req, q.Name, qtype, false)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(answers)
+}
+
+// queryJSON resolves name and qtype with ServeDNS and returns the response
+// in our JSON format.
+func (s *server) queryJSON(req *http.Request, name string, qtype uint16, cd bool) *jsonMsg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.CheckingDisabled = cd
+	dw := newDohWriter(req)
+	s.ServeDNS(dw, m)
+	if dw.msg == nil {
+		return nil
+	}
+	r := dw.msg
+	j := &jsonMsg{Status: r.Rcode, TC: r.Truncated, RD: r.RecursionDesired, RA: r.RecursionAvailable,
+		AD: r.AuthenticatedData, CD: r.CheckingDisabled}
+	for _, q := range r.Question {
+		j.Question = append(j.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	j.Answer = jsonRRs(r.Answer)
+	j.Authority = jsonRRs(r.Ns)
+	return j
+}
+
+// parseType parses a query type given as a number, a mnemonic or as TYPEn,
+// an empty string is type A.
+func parseType(t string) (uint16, bool) {
+	if t == "" {
+		return dns.TypeA, true
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(t, "TYPE")); err == nil {
+		return uint16(n), true
+	}
+	n, ok := dns.StringToType[strings.ToUpper(t)]
+	return n, ok
+}
+
+func jsonRRs(rrs []dns.RR) (j []jsonRR) {
+	for _, r := range rrs {
+		h := r.Header()
+		j = append(j, jsonRR{Name: h.Name, Type: h.Rrtype, TTL: h.Ttl,
+			Data: strings.TrimSpace(strings.TrimPrefix(r.String(), h.String()))})
+	}
+	return j
+}
+
+// minTtl returns the lowest TTL found in the answer and authority sections of m.
+func minTtl(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, r := range append(m.Answer, m.Ns...) {
+		if first || r.Header().Ttl < ttl {
+			ttl = r.Header().Ttl
+			first = false
+		}
+	}
+	return ttl
+}
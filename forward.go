@@ -0,0 +1,153 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rtts tracks a smoothed round trip time for each nameserver we forward to.
+type rtts struct {
+	sync.RWMutex
+	m map[string]time.Duration
+}
+
+func newRtts() *rtts {
+	return &rtts{m: make(map[string]time.Duration)}
+}
+
+// update adds a measurement for nameserver ns. Failures are counted as if the
+// query took penalty.
+func (r *rtts) update(ns string, rtt time.Duration, err error, penalty time.Duration) {
+	if err != nil {
+		rtt = penalty
+	}
+	r.Lock()
+	defer r.Unlock()
+	old, ok := r.m[ns]
+	if !ok {
+		r.m[ns] = rtt
+		return
+	}
+	r.m[ns] = old - old/8 + rtt/8
+}
+
+// fastest returns the n nameservers with the lowest round trip time.
+// Nameservers we don't have a measurement for yet come first.
+func (r *rtts) fastest(nameservers []string, n int) []string {
+	ns := make([]string, len(nameservers))
+	copy(ns, nameservers)
+	r.RLock()
+	sort.Stable(byRtt{ns, r.m})
+	r.RUnlock()
+	if n < len(ns) {
+		ns = ns[:n]
+	}
+	return ns
+}
+
+type byRtt struct {
+	ns []string
+	m  map[string]time.Duration
+}
+
+func (b byRtt) Len() int           { return len(b.ns) }
+func (b byRtt) Swap(i, j int)      { b.ns[i], b.ns[j] = b.ns[j], b.ns[i] }
+func (b byRtt) Less(i, j int) bool { return b.m[b.ns[i]] < b.m[b.ns[j]] }
+
+// forwardRace sends req to all nameservers at once and returns the first
+// successful response and the nameserver that gave it.
+func (s *server) forwardRace(c *dns.Client, req *dns.Msg, nameservers []string) (*dns.Msg, string, error) {
+	type result struct {
+		r   *dns.Msg
+		ns  string
+		err error
+	}
+	ch := make(chan result, len(nameservers))
+	for _, ns := range nameservers {
+		// Exchange packs the query and may change it, each gets its own.
+		go func(req *dns.Msg, ns string) {
+			r, rtt, err := c.Exchange(req, ns)
+			s.rtt.update(ns, rtt, err, s.config.ReadTimeout)
+			ch <- result{r, ns, err}
+		}(req.Copy(), ns)
+	}
+	var err error
+	for range nameservers {
+		res := <-ch
+		if res.err == nil {
+			return res.r, res.ns, nil
+		}
+		err = res.err
+	}
+	return nil, "", err
+}
+
+// health keeps track of the nameservers that are not responding.
+type health struct {
+	sync.RWMutex
+	dead map[string]bool
+}
+
+func newHealth() *health {
+	return &health{dead: make(map[string]bool)}
+}
+
+// set marks nameserver ns as dead or alive.
+func (h *health) set(ns string, dead bool) {
+	h.Lock()
+	defer h.Unlock()
+	if h.dead[ns] != dead {
+		if dead {
+			log.Printf("error: Nameserver %q is not responding", ns)
+		} else {
+			log.Printf("Nameserver %q is responding again", ns)
+		}
+	}
+	h.dead[ns] = dead
+}
+
+// alive returns the nameservers that are not marked dead. If all of them
+// are dead, all nameservers are returned, because we have nothing better.
+func (h *health) alive(nameservers []string) []string {
+	h.RLock()
+	defer h.RUnlock()
+	alive := make([]string, 0, len(nameservers))
+	for _, ns := range nameservers {
+		if !h.dead[ns] {
+			alive = append(alive, ns)
+		}
+	}
+	if len(alive) == 0 {
+		return nameservers
+	}
+	return alive
+}
+
+// checkNameservers periodically queries all nameservers for the root NS
+// records and marks the ones that don't respond as dead. It blocks, so
+// should be run in a goroutine. It returns when the server stops.
+func (s *server) checkNameservers() {
+	c := &dns.Client{ReadTimeout: s.config.ReadTimeout}
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	for {
+		for _, ns := range s.settings().nameservers {
+			_, rtt, err := c.Exchange(m, ns)
+			s.rtt.update(ns, rtt, err, s.config.ReadTimeout)
+			s.health.set(ns, err != nil)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.config.ForwardCheck):
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// frozen holds copies of the subtrees that are frozen, by their key. Names in
+// a frozen subtree are answered from the copy, so changes in etcd, i.e.
+// during maintenance or a migration, are not seen until it is thawed.
+// A subtree is frozen by creating /skydns/freeze/<name>, the value is not used.
+type frozen struct {
+	sync.RWMutex
+	m map[string]*etcd.Response
+}
+
+// get returns the contents of key from a frozen subtree, nil when it is not
+// there. It returns false when key is not frozen.
+func (f *frozen) get(key string) (*etcd.Response, bool) {
+	f.RLock()
+	defer f.RUnlock()
+	for k, r := range f.m {
+		if key != k && !strings.HasPrefix(key, k+"/") {
+			continue
+		}
+		if r == nil {
+			// It didn't exist when it was frozen.
+			return nil, true
+		}
+		if n := findNode(r.Node, key); n != nil {
+			return &etcd.Response{Action: "get", Node: n, EtcdIndex: r.EtcdIndex}, true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// overlay returns r with the frozen subtrees below its key put in place of
+// the ones in etcd, so a recursive get of an ancestor of a frozen key, i.e.
+// the SRV records of a parent domain, sees the same as a get of the key
+// itself. The nodes in r are not changed, as r may be shared.
+func (f *frozen) overlay(key string, r *etcd.Response) *etcd.Response {
+	f.RLock()
+	defer f.RUnlock()
+	var n *etcd.Node
+	if r != nil {
+		n = r.Node
+	}
+	for k, fr := range f.m {
+		if !strings.HasPrefix(k, key+"/") {
+			continue
+		}
+		var with *etcd.Node
+		if fr != nil {
+			with = fr.Node
+		}
+		if n == nil {
+			if with == nil {
+				continue
+			}
+			// key was removed after k was frozen.
+			n = &etcd.Node{Key: key, Dir: true}
+		}
+		if n.Dir {
+			n = replaceNode(n, k, with)
+		}
+	}
+	if r == nil {
+		if n == nil {
+			return nil
+		}
+		return &etcd.Response{Action: "get", Node: n}
+	}
+	if n == r.Node {
+		return r
+	}
+	c := *r
+	c.Node = n
+	return &c
+}
+
+// replaceNode returns a copy of the tree n with the node with key replaced
+// by with, or removed when with is nil. Only the nodes on the way to key are
+// copied, missing directories are created.
+func replaceNode(n *etcd.Node, key string, with *etcd.Node) *etcd.Node {
+	c := *n
+	c.Nodes = make(etcd.Nodes, 0, len(n.Nodes)+1)
+	found := false
+	for _, child := range n.Nodes {
+		switch {
+		case child.Key == key:
+			found = true
+			if with != nil {
+				c.Nodes = append(c.Nodes, with)
+			}
+		case child.Dir && strings.HasPrefix(key, child.Key+"/"):
+			found = true
+			c.Nodes = append(c.Nodes, replaceNode(child, key, with))
+		default:
+			c.Nodes = append(c.Nodes, child)
+		}
+	}
+	if found || with == nil {
+		return &c
+	}
+	if i := strings.Index(key[len(n.Key)+1:], "/"); i >= 0 {
+		dir := &etcd.Node{Key: key[:len(n.Key)+1+i], Dir: true}
+		c.Nodes = append(c.Nodes, replaceNode(dir, key, with))
+		return &c
+	}
+	c.Nodes = append(c.Nodes, with)
+	return &c
+}
+
+// findNode returns the node with key in the tree n, or nil.
+func findNode(n *etcd.Node, key string) *etcd.Node {
+	if n.Key == key {
+		return n
+	}
+	for _, c := range n.Nodes {
+		if key == c.Key || strings.HasPrefix(key, c.Key+"/") {
+			return findNode(c, key)
+		}
+	}
+	return nil
+}
+
+// freeze makes the frozen subtrees the ones in names (keys below
+// /skydns/freeze), copying the subtrees that are newly frozen from etcd.
+func (s *server) freeze(names []string) error {
+	s.frozen.RLock()
+	m := make(map[string]*etcd.Response, len(names))
+	for _, name := range names {
+		key := path(strings.ToLower(dns.Fqdn(name)))
+		if r, ok := s.frozen.m[key]; ok {
+			m[key] = r
+		}
+	}
+	s.frozen.RUnlock()
+	for _, name := range names {
+		key := path(strings.ToLower(dns.Fqdn(name)))
+		if _, ok := m[key]; ok {
+			continue
+		}
+		r, err := s.client.Get(key, false, true)
+		switch backendError(err) {
+		case nil:
+		case ErrNotFound:
+			r = nil
+		default:
+			return err
+		}
+		log.Printf("Froze %q", name)
+		m[key] = r
+	}
+	s.frozen.Lock()
+	for key := range s.frozen.m {
+		if _, ok := m[key]; !ok {
+			log.Printf("Thawed %q", domain(key))
+		}
+	}
+	s.frozen.m = m
+	s.frozen.Unlock()
+	return nil
+}
+
+// watchFrozen freezes the subtrees listed under /skydns/freeze and thaws
+// them when they are removed. It blocks, so should be run in a goroutine. It
+// returns when the server stops.
+func (s *server) watchFrozen() {
+	var index uint64
+	for {
+		var names []string
+		r, err := s.client.Get("/skydns/freeze", false, false)
+		switch backendError(err) {
+		case nil:
+			for _, n := range r.Node.Nodes {
+				names = append(names, n.Key[strings.LastIndex(n.Key, "/")+1:])
+			}
+			index = r.EtcdIndex + 1
+		case ErrNotFound:
+			index = 0
+		default:
+			log.Printf("error: Failure to get frozen subtrees: %q", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if err := s.freeze(names); err != nil {
+			log.Printf("error: Failure to freeze subtrees: %q", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if _, err := s.client.Watch("/skydns/freeze", index, true, nil, s.stop); err != nil && !s.stopped() {
+			log.Printf("error: Failure to watch frozen subtrees: %q", err)
+			time.Sleep(1 * time.Second)
+		}
+		if s.stopped() {
+			return
+		}
+	}
+}
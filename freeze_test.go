@@ -0,0 +1,51 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestFrozenOverlay(t *testing.T) {
+	live := &etcd.Response{Node: &etcd.Node{Key: "/skydns/local/skydns", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/skydns/production", Dir: true, Nodes: etcd.Nodes{
+			{Key: "/skydns/local/skydns/production/new", Value: `{"Host":"10.0.0.2"}`},
+		}},
+		{Key: "/skydns/local/skydns/staging", Value: `{"Host":"10.0.0.3"}`},
+	}}}
+	old := &etcd.Node{Key: "/skydns/local/skydns/production", Dir: true, Nodes: etcd.Nodes{
+		{Key: "/skydns/local/skydns/production/old", Value: `{"Host":"10.0.0.1"}`},
+	}}
+	f := &frozen{m: map[string]*etcd.Response{"/skydns/local/skydns/production": {Node: old}}}
+
+	r := f.overlay("/skydns/local/skydns", live)
+	if n := findNode(r.Node, "/skydns/local/skydns/production/old"); n == nil {
+		t.Fatalf("frozen node not in ancestor response")
+	}
+	if n := findNode(r.Node, "/skydns/local/skydns/production/new"); n != nil {
+		t.Fatalf("live node %q in frozen subtree", n.Key)
+	}
+	if n := findNode(r.Node, "/skydns/local/skydns/staging"); n == nil {
+		t.Fatalf("sibling of frozen subtree removed")
+	}
+	if n := findNode(live.Node, "/skydns/local/skydns/production/new"); n == nil {
+		t.Fatalf("live response changed")
+	}
+
+	// Removed in etcd after it was frozen.
+	r = f.overlay("/skydns/local", nil)
+	if r == nil || findNode(r.Node, "/skydns/local/skydns/production/old") == nil {
+		t.Fatalf("frozen node not in response of removed ancestor")
+	}
+
+	// Didn't exist when it was frozen.
+	f.m["/skydns/local/skydns/production"] = nil
+	r = f.overlay("/skydns/local/skydns", live)
+	if n := findNode(r.Node, "/skydns/local/skydns/production"); n != nil {
+		t.Fatalf("node %q created after freeze is seen", n.Key)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build gofuzz
+// +build gofuzz
+
+package main
+
+import (
+	"net"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// fuzzServer answers from an empty in-memory zone and doesn't forward, so
+// fuzzing doesn't need etcd or the network.
+var fuzzServer = func() *server {
+	config := &Config{Nameservers: []string{}}
+	if err := setDefaults(config); err != nil {
+		panic(err)
+	}
+	config.Nameservers = nil
+	s := NewServer(config, nil)
+	s.zone = newZone(nil, 0)
+	s.zone.restore(&etcd.Node{Key: "/skydns", Dir: true}, 1)
+	return s
+}()
+
+// Fuzz is the entry point for go-fuzz, it feeds data as a query to ServeDNS.
+// Run with go-fuzz-build -tags gofuzz and go-fuzz.
+func Fuzz(data []byte) int {
+	req := new(dns.Msg)
+	if err := req.Unpack(data); err != nil {
+		return 0
+	}
+	w := &dohWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+	fuzzServer.ServeDNS(w, req)
+	if w.msg == nil {
+		return 0
+	}
+	return 1
+}
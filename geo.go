@@ -0,0 +1,142 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// geoTable maps networks to locations, i.e. a region or a datacenter.
+type geoTable struct {
+	nets []geoNet
+}
+
+type geoNet struct {
+	net      *net.IPNet
+	location string
+}
+
+// newGeoTable creates a table from networks in CIDR notation mapping to a
+// location and from file. Each line in file is "network,location", which is
+// the layout of the first two columns of a MaxMind GeoLite2 blocks CSV file.
+func newGeoTable(networks map[string]string, file string) (*geoTable, error) {
+	g := new(geoTable)
+	for n, l := range networks {
+		if err := g.add(n, l); err != nil {
+			return nil, err
+		}
+	}
+	if file == "" {
+		return g, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || fields[0] == "network" {
+			continue
+		}
+		if err := g.add(fields[0], fields[1]); err != nil {
+			return nil, err
+		}
+	}
+	return g, scanner.Err()
+}
+
+func (g *geoTable) add(network, location string) error {
+	_, n, err := net.ParseCIDR(strings.TrimSpace(network))
+	if err != nil {
+		return err
+	}
+	g.nets = append(g.nets, geoNet{n, strings.TrimSpace(location)})
+	return nil
+}
+
+// location returns the location of ip, using the most specific network that
+// contains it. An empty string is returned when ip is not found.
+func (g *geoTable) location(ip net.IP) string {
+	location, best := "", -1
+	for _, n := range g.nets {
+		if !n.net.Contains(ip) {
+			continue
+		}
+		if ones, _ := n.net.Mask.Size(); ones > best {
+			location, best = n.location, ones
+		}
+	}
+	return location
+}
+
+// geoSort moves the address records that are in the same location as the
+// client to the front, the order is otherwise left alone.
+func (s *server) geoSort(records []dns.RR, client net.IP, name string) []dns.RR {
+	if s.config.geo == nil || client == nil || len(records) < 2 || !s.geoZone(name) {
+		return records
+	}
+	location := s.config.geo.location(client)
+	if location == "" {
+		return records
+	}
+	near := make([]dns.RR, 0, len(records))
+	far := make([]dns.RR, 0, len(records))
+	for _, r := range records {
+		var ip net.IP
+		switch a := r.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		}
+		// Records without an address, a CNAME, stay in front.
+		if ip == nil || s.config.geo.location(ip) == location {
+			near = append(near, r)
+			continue
+		}
+		far = append(far, r)
+	}
+	return append(near, far...)
+}
+
+// geoZone returns true when name is in one of the zones that have GeoIP
+// sorting enabled, when no zones are configured it is enabled for all names.
+func (s *server) geoZone(name string) bool {
+	if len(s.config.GeoZones) == 0 {
+		return true
+	}
+	for _, z := range s.config.GeoZones {
+		if name == z || strings.HasSuffix(name, "."+z) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client, an EDNS0 client subnet
+// option takes precedence over the source address.
+func clientIP(w dns.ResponseWriter, req *dns.Msg) net.IP {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok && e.Address != nil {
+				return e.Address
+			}
+		}
+	}
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Latency histograms, the query and forward ones are per "qtype/rcode".
+var (
+	statsQueryDuration   = newHistogramVec("skydns_query_duration")
+	statsForwardDuration = newHistogramVec("skydns_forward_duration")
+	statsBackendDuration = newHistogram("skydns_backend_duration")
+)
+
+// histogramBuckets are the upper bounds of the buckets, in seconds.
+var histogramBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// histogram counts durations in cumulative buckets, like Prometheus does.
+// It is exported via expvar as {"buckets":{"0.001":n,...},"count":n,"sum":s}.
+type histogram struct {
+	sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name string) *histogram {
+	h := &histogram{counts: make([]uint64, len(histogramBuckets))}
+	if name != "" {
+		expvar.Publish(name, h)
+	}
+	return h
+}
+
+// observe adds d to the histogram.
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range histogramBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// String implements expvar.Var.
+func (h *histogram) String() string {
+	h.Lock()
+	defer h.Unlock()
+	j := struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+	}{make(map[string]uint64, len(h.counts)), h.count, h.sum}
+	for i, b := range histogramBuckets {
+		j.Buckets[strconv.FormatFloat(b, 'f', -1, 64)] = h.counts[i]
+	}
+	buf, _ := json.Marshal(j)
+	return string(buf)
+}
+
+// histogramVec is a set of histograms, one per label.
+type histogramVec struct {
+	sync.RWMutex
+	h map[string]*histogram
+}
+
+func newHistogramVec(name string) *histogramVec {
+	v := &histogramVec{h: make(map[string]*histogram)}
+	expvar.Publish(name, v)
+	return v
+}
+
+// observe adds d to the histogram for label.
+func (v *histogramVec) observe(label string, d time.Duration) {
+	v.RLock()
+	h, ok := v.h[label]
+	v.RUnlock()
+	if !ok {
+		v.Lock()
+		if h, ok = v.h[label]; !ok {
+			h = newHistogram("")
+			v.h[label] = h
+		}
+		v.Unlock()
+	}
+	h.observe(d)
+}
+
+// String implements expvar.Var.
+func (v *histogramVec) String() string {
+	v.RLock()
+	defer v.RUnlock()
+	j := make(map[string]json.RawMessage, len(v.h))
+	for l, h := range v.h {
+		j[l] = json.RawMessage(h.String())
+	}
+	buf, _ := json.Marshal(j)
+	return string(buf)
+}
+
+// typeString returns the mnemonic for qtype, or TYPEnnn for unknown types.
+func typeString(qtype uint16) string {
+	if t, ok := dns.TypeToString[qtype]; ok {
+		return t
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
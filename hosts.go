@@ -0,0 +1,164 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hosts holds the names and addresses from dnsmasq style hosts files (as
+// used with addn-hosts). Names without a dot get our domain appended, like
+// dnsmasq's expand-hosts.
+type hosts struct {
+	sync.RWMutex
+	files  []string
+	domain string
+	mod    map[string]time.Time
+	names  map[string][]net.IP // name to addresses
+	addrs  map[string][]string // address to names
+}
+
+// newHosts reads the hosts files.
+func newHosts(files []string, domain string) (*hosts, error) {
+	h := &hosts{files: files, domain: domain}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load (re)reads all the hosts files.
+func (h *hosts) load() error {
+	mod := make(map[string]time.Time)
+	names := make(map[string][]net.IP)
+	addrs := make(map[string][]string)
+	for _, file := range h.files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		if fi, err := f.Stat(); err == nil {
+			mod[file] = fi.ModTime()
+		}
+		err = parseHosts(f, h.domain, names, addrs)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	h.Lock()
+	h.mod, h.names, h.addrs = mod, names, addrs
+	h.Unlock()
+	return nil
+}
+
+// watch rereads the hosts files when one of them changed. It blocks, so
+// should be run in a goroutine. It returns when stop is closed.
+func (h *hosts) watch(interval time.Duration, stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if !h.changed() {
+			continue
+		}
+		if err := h.load(); err != nil {
+			log.Printf("error: Failure to reload hosts files: %q", err)
+			continue
+		}
+		log.Printf("Reloaded hosts files %q", h.files)
+	}
+}
+
+// changed returns true when the modification time of one of the files changed.
+func (h *hosts) changed() bool {
+	h.RLock()
+	defer h.RUnlock()
+	for _, file := range h.files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(h.mod[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the addresses for name.
+func (h *hosts) lookup(name string) []net.IP {
+	h.RLock()
+	defer h.RUnlock()
+	return h.names[strings.ToLower(name)]
+}
+
+// reverse returns the names for ip.
+func (h *hosts) reverse(ip net.IP) []string {
+	h.RLock()
+	defer h.RUnlock()
+	return h.addrs[ip.String()]
+}
+
+// parseHosts parses a hosts file: an address followed by one or more names
+// on each line, comments start with a #.
+func parseHosts(r io.Reader, domain string, names map[string][]net.IP, addrs map[string][]string) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, n := range fields[1:] {
+			n = strings.ToLower(n)
+			if !strings.Contains(n, ".") {
+				n = n + "." + domain
+			}
+			n = dns.Fqdn(n)
+			if _, ok := dns.IsDomainName(n); !ok {
+				continue
+			}
+			names[n] = append(names[n], ip)
+			addrs[ip.String()] = append(addrs[ip.String()], n)
+		}
+	}
+	return scanner.Err()
+}
+
+// hostsRecords returns the A or AAAA records (depending on q.Qtype) for
+// q.Name from the hosts files.
+func (s *server) hostsRecords(q dns.Question) (records []dns.RR) {
+	if s.config.hosts == nil {
+		return nil
+	}
+	for _, ip := range s.config.hosts.lookup(q.Name) {
+		switch {
+		case ip.To4() != nil && q.Qtype == dns.TypeA:
+			records = append(records, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.settings().minTtl}, A: ip.To4()})
+		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
+			records = append(records, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.settings().minTtl}, AAAA: ip.To16()})
+		}
+	}
+	return records
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// registration is the body of a PUT request. It is compatible with the
+// SkyDNS1 API: unknown fields are ignored and the TTL is used as the TTL
+// of the key in etcd.
+type registration struct {
+	Service
+	TTL uint64
+}
+
+// runHTTPServer serves the HTTP API on HttpAddr, it only returns with an error.
+// The registration API, the cache and the counters need authentication, when
+// configured, the DNS queries do not.
+func runHTTPServer(s *server) error {
+	mux := http.NewServeMux()
+	mux.Handle("/skydns/services/", s.authenticate(s))
+	mux.HandleFunc("/dns-query", s.ServeDoH)
+	mux.HandleFunc("/resolve", s.ServeDoHJSON)
+	mux.HandleFunc("/skydns/query", s.ServeBulk)
+	mux.Handle("/skydns/cache", s.authenticate(http.HandlerFunc(s.ServeCache)))
+	mux.Handle("/debug/vars", s.authenticate(http.DefaultServeMux)) // expvar
+	srv := &http.Server{Addr: s.config.HttpAddr, Handler: mux}
+	if s.config.TLSCert == "" {
+		return srv.ListenAndServe()
+	}
+	if s.config.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(s.config.TLSClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %q", s.config.TLSClientCA)
+		}
+		// Clients may still use basic authentication instead.
+		srv.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	return srv.ListenAndServeTLS(s.config.TLSCert, s.config.TLSKey)
+}
+
+// ServeHTTP implements the registration API. Services are registered with
+// a PUT to /skydns/services/<name>, where name is a domain name under our
+// domain, and are removed with a DELETE. A DELETE of *.<name> (or <name>
+// with ?recursive=true) removes everything under name, see deleteSubtree.
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/skydns/services/")
+	name = dns.Fqdn(strings.ToLower(name))
+	recursive := req.URL.Query().Get("recursive") == "true"
+	if req.Method == "DELETE" && strings.HasPrefix(name, "*.") {
+		name = name[2:]
+		recursive = true
+	}
+	if _, ok := dns.IsDomainName(name); !ok || s.zoneOf(name) == "" || name == s.zoneOf(name) {
+		http.Error(w, "name not in "+strings.Join(append([]string{s.config.Domain}, s.config.Domains...), ", "), http.StatusBadRequest)
+		return
+	}
+	key := path(name)
+
+	operation := ""
+	switch req.Method {
+	case "PUT":
+		operation = "register"
+	case "DELETE":
+		operation = "delete"
+	}
+	if operation != "" && !s.authorized(req, name, operation) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		r, err := s.client.Get(key, false, false)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if r.Node.Dir {
+			http.Error(w, "name is not a service", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(r.Node.Value))
+	case "PUT":
+		var reg registration
+		if err := json.NewDecoder(req.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reg.Host == "" && reg.RR == "" && reg.Text == "" && len(reg.TXT) == 0 {
+			http.Error(w, "host, text or rr must be set", http.StatusBadRequest)
+			return
+		}
+		if _, err := reg.txt(); err != nil {
+			http.Error(w, "invalid text: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.config.CNAMEPolicy == "reject" && reg.Host != "" && net.ParseIP(reg.Host) == nil && s.zoneOf(dns.Fqdn(reg.Host)) == "" {
+			http.Error(w, "host not in "+strings.Join(append([]string{s.config.Domain}, s.config.Domains...), ", "), http.StatusBadRequest)
+			return
+		}
+		if reg.RR != "" {
+			if rr, err := dns.NewRR(reg.RR); err != nil || rr == nil {
+				http.Error(w, "invalid rr", http.StatusBadRequest)
+				return
+			}
+		}
+		value, err := json.Marshal(reg.Service)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if max := s.config.MaxValueSize; max > 0 && len(value) > max {
+			http.Error(w, "service larger than "+strconv.Itoa(max)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, err := s.client.Set(key, string(value), reg.TTL); err != nil {
+			httpError(w, err)
+			return
+		}
+		log.Printf("Registered %q at %q", name, key)
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		if recursive {
+			s.deleteSubtree(w, name, key, req.URL.Query().Get("confirm") == "true")
+			return
+		}
+		if _, err := s.client.Delete(key, false); err != nil {
+			httpError(w, err)
+			return
+		}
+		log.Printf("Removed %q at %q", name, key)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deletion is the response to a subtree delete.
+type deletion struct {
+	DryRun bool     `json:"dry_run"`
+	Keys   []string `json:"keys"`
+}
+
+// deleteSubtree removes all registrations under name. Without confirm this is
+// a dry run, that only lists the keys that would be removed.
+func (s *server) deleteSubtree(w http.ResponseWriter, name, key string, confirm bool) {
+	r, err := s.client.Get(key, false, true)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	d := &deletion{DryRun: !confirm, Keys: leafKeys(r.Node, nil)}
+	if confirm {
+		if _, err := s.client.Delete(key, true); err != nil {
+			httpError(w, err)
+			return
+		}
+		log.Printf("Removed %d keys under %q at %q", len(d.Keys), name, key)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// leafKeys appends the keys of all non-directory nodes under n to keys.
+func leafKeys(n *etcd.Node, keys []string) []string {
+	if !n.Dir {
+		return append(keys, n.Key)
+	}
+	for _, c := range n.Nodes {
+		keys = leafKeys(c, keys)
+	}
+	return keys
+}
+
+// ServeCache shows the number of cached signatures with a GET and flushes
+// the cache with a DELETE.
+func (s *server) ServeCache(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Signatures int `json:"signatures"`
+		}{cache.len()})
+	case "DELETE":
+		cache.flush()
+		log.Printf("Signature cache flushed")
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// httpError translates an etcd error into an HTTP error.
+func httpError(w http.ResponseWriter, err error) {
+	if backendError(err) == ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == 102 { // not a file
+		http.Error(w, e.Message, http.StatusConflict)
+		return
+	}
+	log.Printf("error: Failure to talk to etcd: %q", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
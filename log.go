@@ -0,0 +1,93 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// rateLogger limits the number of log messages per class, where the class is the
+// format string. At most limit messages of a class are logged each second,
+// the rest is suppressed and summarized once a second.
+type rateLogger struct {
+	sync.Mutex
+	limit   int
+	classes map[string]*logClass
+	once    sync.Once
+}
+
+type logClass struct {
+	start      time.Time
+	n          int
+	suppressed int
+}
+
+var logger = &rateLogger{limit: 10, classes: make(map[string]*logClass)}
+
+// logf logs like log.Printf, but is rate limited. Use it for messages that
+// can be triggered by every query.
+func logf(format string, v ...interface{}) {
+	logger.printf(format, v...)
+}
+
+// setLimit sets the number of messages per class logged each second.
+func (l *rateLogger) setLimit(limit int) {
+	l.Lock()
+	l.limit = limit
+	l.Unlock()
+}
+
+func (l *rateLogger) printf(format string, v ...interface{}) {
+	now := time.Now()
+	l.Lock()
+	if l.limit <= 0 {
+		l.Unlock()
+		log.Printf(format, v...)
+		return
+	}
+	c, ok := l.classes[format]
+	if !ok {
+		c = &logClass{start: now}
+		l.classes[format] = c
+	}
+	if now.Sub(c.start) >= time.Second {
+		c.summarize(format)
+		c.start, c.n = now, 0
+	}
+	c.n++
+	if c.n > l.limit {
+		c.suppressed++
+		l.Unlock()
+		l.once.Do(func() { go l.flush() })
+		return
+	}
+	l.Unlock()
+	log.Printf(format, v...)
+}
+
+// flush summarizes the suppressed messages every second, so we also see
+// them when no new messages of a class are logged.
+func (l *rateLogger) flush() {
+	for {
+		time.Sleep(time.Second)
+		now := time.Now()
+		l.Lock()
+		for format, c := range l.classes {
+			if now.Sub(c.start) >= time.Second {
+				c.summarize(format)
+			}
+		}
+		l.Unlock()
+	}
+}
+
+func (c *logClass) summarize(format string) {
+	if c.suppressed > 0 {
+		log.Printf("Suppressed %d similar messages: %q", c.suppressed, format)
+		c.suppressed = 0
+	}
+}
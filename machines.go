@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// validateMachines checks that the etcd machines are URLs that we can
+// resolve. Machines may be given as hostnames, i.e. when using an etcd
+// proxy or a load balancer in front of etcd.
+func validateMachines(machines []string) error {
+	ok := 0
+	for _, m := range machines {
+		if _, err := resolveMachine(m); err != nil {
+			log.Printf("error: Failure to resolve etcd machine %q: %q", m, err)
+			continue
+		}
+		ok++
+	}
+	if ok == 0 {
+		return fmt.Errorf("no usable etcd machines in %q", machines)
+	}
+	return nil
+}
+
+// resolveMachine returns the IP addresses for the etcd machine m.
+func resolveMachine(m string) ([]net.IP, error) {
+	u, err := url.Parse(m)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	h := u.Host
+	if host, _, err := net.SplitHostPort(u.Host); err == nil {
+		h = host
+	}
+	if ip := net.ParseIP(h); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return net.LookupIP(h)
+}
+
+// machineAddrs keeps the resolved addresses of the etcd machines, which are
+// used for the nameserver records. Resolving is done in the background, so
+// queries don't have to wait for it.
+type machineAddrs struct {
+	sync.RWMutex
+	ips      []net.IP
+	resolved bool // resolve has run
+}
+
+// addrs returns the addresses of the etcd machines.
+func (m *machineAddrs) addrs() []net.IP {
+	m.RLock()
+	defer m.RUnlock()
+	return m.ips
+}
+
+// resolve resolves all machines, machines that fail to resolve are skipped.
+// Changes in the addresses are logged.
+func (m *machineAddrs) resolve(cluster []string) {
+	var ips []net.IP
+	for _, c := range cluster {
+		a, err := resolveMachine(c)
+		if err != nil {
+			logf("error: Failure to resolve etcd machine %q: %q", c, err)
+			continue
+		}
+		ips = append(ips, a...)
+	}
+	m.Lock()
+	changed := !m.resolved || !sameIPs(m.ips, ips)
+	m.ips, m.resolved = ips, true
+	m.Unlock()
+	if !changed {
+		return
+	}
+	if len(ips) == 0 {
+		log.Printf("error: No etcd machines found, using static nameserver addresses")
+		return
+	}
+	log.Printf("Using the addresses of the etcd machines %q for the nameserver", ips)
+}
+
+// sameIPs returns true when a and b hold the same addresses in the same order.
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshMachines resolves the etcd machines every interval. It blocks, so should
+// be run in a goroutine. It returns when the server stops.
+func (s *server) refreshMachines(interval time.Duration) {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(interval):
+		}
+		s.machines.resolve(s.client.GetCluster())
+	}
+}
@@ -5,31 +5,237 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/coreos/go-etcd/etcd"
 )
 
-var machines = strings.Split(os.Getenv("ETCD_MACHINES"), ",")
+var (
+	machines = strings.Split(os.Getenv("ETCD_MACHINES"), ",")
+	selftest = flag.Bool("selftest", false, "query ourselves after startup, report and exit")
+	proxy    = flag.Bool("etcd-proxy", false, "the etcd machines are proxies or load balancers, don't sync the cluster")
+	snapshot = flag.String("snapshot", "", "periodically write a snapshot of etcd to this file, used when etcd is unreachable at startup")
+	interval = flag.Duration("snapshot-interval", 5*time.Minute, "interval between snapshots")
+	addr     = flag.String("addr", "", "comma separated addresses to listen on for DNS, overrides dns_addr")
+	tcpAddr  = flag.String("tcp-addr", "", "comma separated addresses to listen on for DNS over TCP, overrides -addr")
+	udpAddr  = flag.String("udp-addr", "", "comma separated addresses to listen on for DNS over UDP, overrides -addr")
+	stats    = flag.String("stats", "", "save the counters to this file, or etcd key with etcd:<key>, to keep them across restarts")
+	statsInt = flag.Duration("stats-interval", time.Minute, "interval between saving the counters")
+	domains  = flag.String("domains", "", "comma separated domains we are authoritative for, overrides domain and domains")
+	retries  = flag.Int("etcd-retries", 0, "number of times to retry reaching etcd at startup, with backoff, -1 retries forever")
+	workers  = flag.Int("udp-workers", 0, "number of UDP sockets per address, opened with SO_REUSEPORT (Linux only)")
 
-func newClient() *etcd.Client {
+	// Authentication to etcd, the environment variables are the defaults.
+	etcdCert     = flag.String("etcd-cert", os.Getenv("ETCD_CERTFILE"), "client certificate for etcd")
+	etcdKey      = flag.String("etcd-key", os.Getenv("ETCD_KEYFILE"), "key of the client certificate for etcd")
+	etcdCACert   = flag.String("etcd-cacert", os.Getenv("ETCD_CAFILE"), "CA bundle to verify the certificate of etcd")
+	etcdInsecure = flag.Bool("etcd-insecure-skip-verify", os.Getenv("ETCD_INSECURE_SKIP_VERIFY") != "", "don't verify the certificate of etcd")
+	etcdUser     = flag.String("etcd-username", os.Getenv("ETCD_USERNAME"), "username for etcd")
+	etcdPassword = flag.String("etcd-password", os.Getenv("ETCD_PASSWORD"), "password for etcd")
+
+	// Replaying a query log against two instances.
+	replayLog    = flag.String("replay", "", "replay the queries in this query log against -replay-reference and -replay-shadow, report the differences and exit")
+	replayRef    = flag.String("replay-reference", "127.0.0.1:53", "address of the instance to compare against")
+	replayShadow = flag.String("replay-shadow", "", "address of the instance under test")
+)
+
+func newClient() (*etcd.Client, error) {
 	client := etcd.NewClient(machines)
-	client.SyncCluster()
-	return client
+	if *etcdCert != "" || *etcdCACert != "" || *etcdInsecure {
+		config, err := etcdTLSConfig(*etcdCert, *etcdKey, *etcdCACert, *etcdInsecure)
+		if err != nil {
+			return nil, err
+		}
+		client.SetTransport(&http.Transport{
+			Dial:                (&net.Dialer{Timeout: time.Second, KeepAlive: time.Second}).Dial,
+			TLSClientConfig:     config,
+			TLSHandshakeTimeout: 10 * time.Second,
+		})
+	}
+	if *etcdUser != "" {
+		client.SetCredentials(*etcdUser, *etcdPassword)
+	}
+	if !*proxy {
+		// Syncing replaces the machines with the ones advertised by the
+		// cluster, which is not what we want when talking to a proxy.
+		client.SyncCluster()
+	}
+	return client, nil
+}
+
+// waitForEtcd tries to reach etcd, retrying retries times (forever when
+// negative) with an exponential backoff with jitter, so we can be started
+// before etcd, also before the names of the etcd machines resolve. It
+// returns an error when none of the machines resolve after the last retry,
+// when etcd stays unreachable it is up to the caller to fail.
+func waitForEtcd(client *etcd.Client, retries int) error {
+	backoff := 500 * time.Millisecond
+	for i := 0; ; i++ {
+		verr := validateMachines(machines)
+		err := verr
+		if verr == nil {
+			if _, err = client.Get("/skydns/config", false, false); backendError(err) != ErrUnavailable {
+				return nil
+			}
+		}
+		if retries >= 0 && i >= retries {
+			return verr
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		log.Printf("error: Failure to reach etcd (attempt %d): %q, retrying in %s", i+1, err, wait)
+		time.Sleep(wait)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// etcdTLSConfig returns the TLS config for talking to etcd: with the client
+// certificate in cert and key, verifying the certificate of etcd with the CA
+// bundle in caCert (or the system roots), unless insecure is set.
+func etcdTLSConfig(cert, key, caCert string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if cert != "" {
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{c}
+	}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", caCert)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
 }
 
 func main() {
-	client := newClient()
+	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
+	if *replayLog != "" {
+		if *replayShadow == "" {
+			log.Fatal("-replay needs -replay-shadow")
+		}
+		queries, diffs, err := replay(*replayLog, *replayRef, *replayShadow, 2*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("replay: %d queries, %d differences", queries, diffs)
+		if diffs > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	client, err := newClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := waitForEtcd(client, *retries); err != nil {
+		log.Fatal(err)
+	}
+
+	var snap *etcd.Node
+	if *snapshot != "" {
+		if _, err := client.Get("/skydns/config", false, false); backendError(err) == ErrUnavailable {
+			log.Printf("error: Failure to reach etcd: %q, using snapshot %q", err, *snapshot)
+			if snap, err = readSnapshot(*snapshot); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
-	config, err := LoadConfig(client)
+	var config *Config
+	if snap != nil {
+		config, err = snapshotConfig(snap)
+	} else {
+		config, err = LoadConfig(client)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *domains != "" {
+		if err := config.setDomains(strings.Split(*domains, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *addr != "" {
+		config.DnsAddr = *addr
+	}
+	if *tcpAddr != "" {
+		config.TCPAddr = *tcpAddr
+	}
+	if *udpAddr != "" {
+		config.UDPAddr = *udpAddr
+	}
+	if *workers > 0 {
+		config.UDPWorkers = *workers
+	}
+	log.Printf("SkyDNS %s (%s)", version, commit)
 	s := NewServer(config, client)
+	s.snap = snap
+	if *snapshot != "" {
+		go s.snapshot(*snapshot, *interval)
+	}
+	if *stats != "" {
+		if err := loadStats(client, *stats); err != nil {
+			log.Printf("error: Failure to load stats: %q", err)
+		}
+		go s.persistStats(*stats, *statsInt)
+	}
+
+	if *selftest {
+		go func() {
+			if err := s.Run(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		if err := selfTest(s); err != nil {
+			log.Printf("selftest: FAIL: %s", err)
+			os.Exit(1)
+		}
+		log.Printf("selftest: PASS")
+		os.Exit(0)
+	}
+
+	// Run returns when we are stopped, wait until the stats are saved.
+	stopped := make(chan bool)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("Received %s, stopping", <-sig)
+		if err := s.Stop(5 * time.Second); err != nil {
+			log.Printf("error: Failure to stop cleanly: %q", err)
+		}
+		if *stats != "" {
+			if err := saveStats(client, *stats); err != nil {
+				log.Printf("error: Failure to save stats: %q", err)
+			}
+		}
+		close(stopped)
+	}()
 
 	if err := s.Run(); err != nil {
 		log.Fatal(err)
 	}
+	<-stopped
 }
@@ -0,0 +1,145 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// marathonSync registers the tasks of the Marathon apps as services under
+// MarathonDomain. App /group/web is web.group.<MarathonDomain> and each of
+// its tasks is a service below that name. Marathon is polled every
+// MarathonInterval. The subtree under MarathonDomain is owned by
+// marathonSync, it is cleared at startup.
+type marathonSync struct {
+	s        *server
+	url      string
+	domain   string
+	interval time.Duration
+	client   *http.Client
+	keys     map[string]string // etcd key to the registered value
+}
+
+type marathonTask struct {
+	AppID string `json:"appId"`
+	ID    string `json:"id"`
+	Host  string `json:"host"`
+	Ports []int  `json:"ports"`
+}
+
+func newMarathonSync(s *server) *marathonSync {
+	return &marathonSync{s: s, url: strings.TrimSuffix(s.config.Marathon, "/"), domain: s.config.MarathonDomain,
+		interval: s.config.MarathonInterval, client: &http.Client{Timeout: 10 * time.Second}, keys: make(map[string]string)}
+}
+
+// run polls Marathon. It blocks, so should be run in a goroutine. It returns
+// when the server stops.
+func (m *marathonSync) run() {
+	if _, err := m.s.client.Delete(path(m.domain), true); err != nil && backendError(err) != ErrNotFound {
+		log.Printf("error: Failure to clear %q: %q", m.domain, err)
+	}
+	for {
+		if err := m.sync(); err != nil {
+			log.Printf("error: Failure to sync Marathon tasks: %q", err)
+		}
+		select {
+		case <-m.s.stop:
+			return
+		case <-time.After(m.interval):
+		}
+	}
+}
+
+// sync registers new and changed tasks and removes the ones that are gone.
+func (m *marathonSync) sync() error {
+	tasks, err := m.tasks()
+	if err != nil {
+		return err
+	}
+	want := make(map[string]string)
+	for _, t := range tasks {
+		key, value, ok := m.service(t)
+		if ok {
+			want[key] = value
+		}
+	}
+	for key, value := range want {
+		if m.keys[key] == value {
+			continue
+		}
+		if _, err := m.s.client.Set(key, value, 0); err != nil {
+			log.Printf("error: Failure to register task at %q: %q", key, err)
+			continue
+		}
+		m.keys[key] = value
+		log.Printf("Registered task at %q", key)
+	}
+	for key := range m.keys {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if _, err := m.s.client.Delete(key, false); err != nil && backendError(err) != ErrNotFound {
+			log.Printf("error: Failure to remove task at %q: %q", key, err)
+			continue
+		}
+		delete(m.keys, key)
+		log.Printf("Removed task at %q", key)
+	}
+	return nil
+}
+
+// tasks returns the running tasks of all apps.
+func (m *marathonSync) tasks() ([]marathonTask, error) {
+	req, err := http.NewRequest("GET", m.url+"/v2/tasks", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("marathon: %s", resp.Status)
+	}
+	var r struct {
+		Tasks []marathonTask `json:"tasks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return r.Tasks, nil
+}
+
+// service returns the key and the value of the service for task t.
+func (m *marathonSync) service(t marathonTask) (string, string, bool) {
+	labels := strings.Split(strings.Trim(strings.ToLower(t.AppID), "/"), "/")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	name := strings.Join(labels, ".") + "." + m.domain
+	if _, ok := dns.IsDomainName(name); !ok || t.Host == "" || t.ID == "" {
+		return "", "", false
+	}
+	serv := &Service{Host: t.Host}
+	if len(t.Ports) > 0 {
+		serv.Port = t.Ports[0]
+	}
+	value, err := json.Marshal(serv)
+	if err != nil {
+		return "", "", false
+	}
+	// Task IDs look like web.1b5c1d9e-..., the dots would make extra labels.
+	id := strings.Replace(strings.ToLower(t.ID), ".", "-", -1)
+	return path(name) + "/" + id, string(value), true
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mirror sends a sample of the queries we get to another nameserver, over
+// UDP, for analysis or to warm the cache of a standby. The replies are
+// ignored. Queries are dropped when the mirror can not keep up, so it never
+// slows down our replies.
+type mirror struct {
+	addr   string
+	sample float64
+	ch     chan []byte
+}
+
+func newMirror(addr string, sample float64) *mirror {
+	return &mirror{addr: addr, sample: sample, ch: make(chan []byte, 1000)}
+}
+
+// add queues req for mirroring, if it is part of the sample.
+func (m *mirror) add(req *dns.Msg) {
+	if m.sample < 1 && rand.Float64() >= m.sample {
+		return
+	}
+	buf, err := req.Pack()
+	if err != nil {
+		return
+	}
+	select {
+	case m.ch <- buf:
+	default:
+		statsMirrorDropCount.Add(1)
+	}
+}
+
+// run sends the queued queries. It blocks, so should be run in a goroutine.
+// It returns when stop is closed.
+func (m *mirror) run(stop chan bool) {
+	for {
+		conn, err := net.Dial("udp", m.addr)
+		if err != nil {
+			log.Printf("error: Failure to mirror queries to %q: %q", m.addr, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		go func() {
+			// Throw away the replies, this ends when conn is closed.
+			buf := make([]byte, dns.MaxMsgSize)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Temporary() {
+						continue
+					}
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case <-stop:
+				conn.Close()
+				return
+			case buf := <-m.ch:
+				conn.Write(buf)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ednsOrigin is the EDNS0 option code used for the answer origin, taken from
+// the range for local and experimental use.
+const ednsOrigin = 65001
+
+// The paths an answer can take.
+const (
+	originZone    = "zone"    // the in-memory copy of etcd
+	originEtcd    = "etcd"    // straight from etcd
+	originForward = "forward" // from one of the nameservers
+	originHosts   = "hosts"   // from the hosts files
+	originLocal   = "local"   // special-use names we answer ourselves
+)
+
+// localOrigin returns the path used for answers from our own domain.
+func (s *server) localOrigin() string {
+	if s.zone != nil {
+		return originZone
+	}
+	return originEtcd
+}
+
+// origin adds the instance name and the path that produced the answer to m.
+// With Origin set to "edns" this is done with an EDNS0 option, but only when
+// req has EDNS0; with "txt" a TXT record is added to the additional section.
+func (s *server) origin(m, req *dns.Msg, path string) {
+	data := s.config.Instance + "/" + path
+	switch s.config.Origin {
+	case "edns":
+		if req.IsEdns0() == nil {
+			return
+		}
+		opt := m.IsEdns0()
+		if opt == nil {
+			opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+			opt.SetUDPSize(dns.MinMsgSize)
+			m.Extra = append(m.Extra, opt)
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsOrigin, Data: []byte(data)})
+	case "txt":
+		m.Extra = append(m.Extra, &dns.TXT{Hdr: dns.RR_Header{Name: "origin." + s.config.Domain, Rrtype: dns.TypeTXT,
+			Class: dns.ClassCHAOS, Ttl: 0}, Txt: []string{data}})
+	}
+}
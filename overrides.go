@@ -0,0 +1,137 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// zoneOverride overrides the runtime settings for the names in a zone. These
+// are stored in etcd under /skydns/zones/<zone>, i.e.
+// /skydns/zones/east.skydns.local. with {"ttl":30,"round_robin":false}.
+// Nameservers are used for forwarding the names in zone. Priority and Weight
+// are used for the services in zone that don't set these.
+type zoneOverride struct {
+	Ttl         *uint32  `json:"ttl,omitempty"`
+	MinTtl      *uint32  `json:"min_ttl,omitempty"`
+	RoundRobin  *bool    `json:"round_robin,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+	Priority    *int     `json:"priority,omitempty"`
+	Weight      *int     `json:"weight,omitempty"`
+}
+
+// overrides holds the zoneOverrides by zone.
+type overrides struct {
+	sync.RWMutex
+	m map[string]*zoneOverride
+}
+
+// lookup returns the override for the longest zone name is in, or nil.
+func (o *overrides) lookup(name string) *zoneOverride {
+	o.RLock()
+	defer o.RUnlock()
+	if len(o.m) == 0 {
+		return nil
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		if z, ok := o.m[name]; ok {
+			return z
+		}
+		i, end := dns.NextLabel(name, 0)
+		if end {
+			return nil
+		}
+		name = name[i:]
+	}
+}
+
+// set replaces all overrides with the ones in n.
+func (o *overrides) set(n *etcd.Node) {
+	m := make(map[string]*zoneOverride)
+	if n != nil {
+		for _, c := range n.Nodes {
+			if c.Dir {
+				continue
+			}
+			z := new(zoneOverride)
+			if err := json.Unmarshal([]byte(c.Value), z); err != nil {
+				log.Printf("error: Failure to parse zone override %q: %q", c.Key, err)
+				continue
+			}
+			zone := c.Key[strings.LastIndex(c.Key, "/")+1:]
+			m[dns.Fqdn(strings.ToLower(zone))] = z
+		}
+	}
+	o.Lock()
+	o.m = m
+	o.Unlock()
+}
+
+// settingsFor returns the runtime settings for name, these are the current
+// settings with the override for the zone of name applied.
+func (s *server) settingsFor(name string) *settings {
+	c := s.settings()
+	z := s.overrides.lookup(name)
+	if z == nil {
+		return c
+	}
+	o := *c
+	if z.Ttl != nil {
+		o.ttl = *z.Ttl
+	}
+	if z.MinTtl != nil {
+		o.minTtl = *z.MinTtl
+	}
+	if z.RoundRobin != nil {
+		o.roundRobin = *z.RoundRobin
+	}
+	if len(z.Nameservers) > 0 {
+		o.nameservers = z.Nameservers
+	}
+	if z.Priority != nil {
+		o.priority = z.Priority
+	}
+	if z.Weight != nil {
+		o.weight = z.Weight
+	}
+	return &o
+}
+
+// watchOverrides loads the zone overrides from /skydns/zones and reloads them
+// when they change. It blocks, so should be run in a goroutine. It returns
+// when the server stops.
+func (s *server) watchOverrides() {
+	var index uint64
+	for {
+		r, err := s.client.Get("/skydns/zones", false, true)
+		switch {
+		case err == nil:
+			s.overrides.set(r.Node)
+			index = r.EtcdIndex + 1
+		case backendError(err) == ErrNotFound:
+			s.overrides.set(nil)
+			index = 0
+		default:
+			log.Printf("error: Failure to get zone overrides: %q", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if _, err := s.client.Watch("/skydns/zones", index, true, nil, s.stop); err != nil && !s.stopped() {
+			log.Printf("error: Failure to watch zone overrides: %q", err)
+			time.Sleep(1 * time.Second)
+		}
+		if s.stopped() {
+			return
+		}
+	}
+}
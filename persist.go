@@ -0,0 +1,145 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// savedStats holds the values of our counters, these are the expvar Ints
+// whose name starts with skydns_ and the Maps of Ints in persistedMaps.
+type savedStats struct {
+	Counters map[string]int64            `json:"counters"`
+	Maps     map[string]map[string]int64 `json:"maps"`
+}
+
+// persistedMaps are the Maps that are saved, these have a fixed set of keys.
+// Maps keyed by names (zones, etcd keys, addresses) can grow without bound,
+// so these start afresh.
+var persistedMaps = map[string]bool{"skydns_rcode": true}
+
+func intValue(v *expvar.Int) int64 {
+	i, _ := strconv.ParseInt(v.String(), 10, 64)
+	return i
+}
+
+// collectStats returns the current values of our counters.
+func collectStats() *savedStats {
+	st := &savedStats{Counters: make(map[string]int64), Maps: make(map[string]map[string]int64)}
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !strings.HasPrefix(kv.Key, "skydns_") {
+			return
+		}
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			st.Counters[kv.Key] = intValue(v)
+		case *expvar.Map:
+			if !persistedMaps[kv.Key] {
+				return
+			}
+			m := make(map[string]int64)
+			v.Do(func(e expvar.KeyValue) {
+				if i, ok := e.Value.(*expvar.Int); ok {
+					m[e.Key] = intValue(i)
+				}
+			})
+			st.Maps[kv.Key] = m
+		}
+	})
+	return st
+}
+
+// restore adds the saved values to our counters.
+func (st *savedStats) restore() {
+	for k, n := range st.Counters {
+		if v, ok := expvar.Get(k).(*expvar.Int); ok {
+			v.Add(n)
+		}
+	}
+	for k, m := range st.Maps {
+		if !persistedMaps[k] {
+			continue
+		}
+		if v, ok := expvar.Get(k).(*expvar.Map); ok {
+			for key, n := range m {
+				v.Add(key, n)
+			}
+		}
+	}
+}
+
+// saveStats writes our counters to target, a file or an etcd key when it
+// starts with "etcd:".
+func saveStats(client *etcd.Client, target string) error {
+	b, err := json.Marshal(collectStats())
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(target, "etcd:") {
+		_, err := client.Set(target[5:], string(b), 0)
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// loadStats reads the counters saved in target and adds them to ours. A
+// missing target is not an error, there is nothing to continue from.
+func loadStats(client *etcd.Client, target string) error {
+	var b []byte
+	if strings.HasPrefix(target, "etcd:") {
+		r, err := client.Get(target[5:], false, false)
+		if err != nil {
+			if backendError(err) == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		b = []byte(r.Node.Value)
+	} else {
+		var err error
+		if b, err = ioutil.ReadFile(target); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	st := new(savedStats)
+	if err := json.Unmarshal(b, st); err != nil {
+		return err
+	}
+	st.restore()
+	return nil
+}
+
+// persistStats periodically saves our counters to target. It blocks, so
+// should be run in a goroutine. It returns when the server stops.
+func (s *server) persistStats(target string, interval time.Duration) {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(interval):
+		}
+		if err := saveStats(s.client, target); err != nil {
+			log.Printf("error: Failure to save stats: %q", err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// postMsg is what is sent to, and read back from, the post processor, as a
+// single line of JSON.
+type postMsg struct {
+	Client   string       `json:"client,omitempty"`
+	Question jsonQuestion `json:"question"`
+	Rcode    int          `json:"rcode"`
+	Answer   []jsonRR     `json:"answer"`
+	Extra    []jsonRR     `json:"extra"`
+}
+
+var errPostTimeout = errors.New("post processor timed out")
+
+// postProcessor sends our answers to an external program, or a service
+// listening on a unix socket, which may change them. The program is started
+// once and is restarted when it fails.
+type postProcessor struct {
+	sync.Mutex
+	command string // "unix:<path>" for a socket
+	timeout time.Duration
+
+	rw  io.ReadWriteCloser // nil when not running
+	r   *bufio.Reader
+	cmd *exec.Cmd
+}
+
+func newPostProcessor(command string, timeout time.Duration) *postProcessor {
+	return &postProcessor{command: command, timeout: timeout}
+}
+
+// pipes are the stdin and stdout of the post processing program.
+type pipes struct {
+	io.WriteCloser
+	out io.ReadCloser
+}
+
+func (p *pipes) Read(b []byte) (int, error) { return p.out.Read(b) }
+
+func (p *pipes) Close() error {
+	p.WriteCloser.Close()
+	return p.out.Close()
+}
+
+func (p *postProcessor) start() error {
+	if strings.HasPrefix(p.command, "unix:") {
+		conn, err := net.DialTimeout("unix", p.command[5:], p.timeout)
+		if err != nil {
+			return err
+		}
+		p.rw, p.r = conn, bufio.NewReader(conn)
+		return nil
+	}
+	cmd := exec.Command("/bin/sh", "-c", p.command)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.rw, p.r, p.cmd = &pipes{in, out}, bufio.NewReader(out), cmd
+	return nil
+}
+
+func (p *postProcessor) stop() {
+	p.rw.Close()
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+	}
+	p.rw, p.r, p.cmd = nil, nil, nil
+}
+
+// process sends m to the post processor and returns what it sends back.
+func (p *postProcessor) process(m *postMsg) (*postMsg, error) {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.rw == nil {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+	type result struct {
+		line []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func(r *bufio.Reader) {
+		line, err := r.ReadBytes('\n')
+		done <- result{line, err}
+	}(p.r)
+	if _, err := p.rw.Write(append(buf, '\n')); err != nil {
+		p.stop()
+		return nil, err
+	}
+	select {
+	case res := <-done:
+		if res.err != nil {
+			p.stop()
+			return nil, res.err
+		}
+		r := new(postMsg)
+		if err := json.Unmarshal(res.line, r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case <-time.After(p.timeout):
+		// Stopping ends the read above.
+		p.stop()
+		return nil, errPostTimeout
+	}
+}
+
+// postProcess hands the answer and additional section of m to the post
+// processor and replaces them with what it returns. When this fails, m is
+// left alone.
+func (s *server) postProcess(w dns.ResponseWriter, req, m *dns.Msg) {
+	pm := &postMsg{Question: jsonQuestion{Name: req.Question[0].Name, Type: req.Question[0].Qtype},
+		Rcode: m.Rcode, Answer: jsonRRs(m.Answer), Extra: jsonRRs(m.Extra)}
+	if ip := remoteIP(w); ip != nil {
+		pm.Client = ip.String()
+	}
+	r, err := s.post.process(pm)
+	if err != nil {
+		statsPostProcessFailureCount.Add(1)
+		logf("error: Failure to post process %q: %q", pm.Question.Name, err)
+		return
+	}
+	answer, err := parseJSONRRs(r.Answer)
+	if err != nil {
+		statsPostProcessFailureCount.Add(1)
+		logf("error: Failure to parse post processed answer for %q: %q", pm.Question.Name, err)
+		return
+	}
+	extra, err := parseJSONRRs(r.Extra)
+	if err != nil {
+		statsPostProcessFailureCount.Add(1)
+		logf("error: Failure to parse post processed answer for %q: %q", pm.Question.Name, err)
+		return
+	}
+	m.Rcode, m.Answer, m.Extra = r.Rcode, answer, extra
+}
+
+// parseJSONRRs is the opposite of jsonRRs.
+func parseJSONRRs(j []jsonRR) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(j))
+	for _, r := range j {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(r.Name), r.TTL, typeString(r.Type), r.Data))
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// The instance that holds ptrLeaderKey maintains the PTR records, so they
+// are written once. It refreshes the key every ptrLeaderTTL/3 seconds.
+const (
+	ptrLeaderKey = "/skydns/config-ptr-leader"
+	ptrLeaderTTL = 30
+)
+
+// ptrPrefix starts the last label of the keys of the PTR records we maintain,
+// so these can be told apart from PTR records registered by hand.
+const ptrPrefix = "ptr-"
+
+// maintainPTR keeps a PTR record in etcd for the address of every service in
+// our domains, under the reverse name of the address, i.e. the service
+// 1.rails.skydns.local with Host 10.0.0.1 gets a PTR record in
+// /skydns/arpa/in-addr/10/0/0/1/ptr-<id>. These get the TTL of the service
+// and are removed when it is. Only one instance does this at a time, see
+// ptrLeaderKey. It blocks, so should be run in a goroutine. It returns when
+// the server stops.
+func (s *server) maintainPTR() {
+	for {
+		if _, err := s.client.Create(ptrLeaderKey, s.config.Instance, ptrLeaderTTL); err == nil {
+			log.Printf("Maintaining PTR records")
+			lost := make(chan bool)
+			go s.leadPTR(lost)
+			s.watchPTR(lost)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(ptrLeaderTTL / 3 * time.Second):
+		}
+	}
+}
+
+// leadPTR refreshes ptrLeaderKey until we stop, it closes lost when the key
+// can't be refreshed, then another instance may take over.
+func (s *server) leadPTR(lost chan bool) {
+	t := time.NewTicker(ptrLeaderTTL / 3 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.client.CompareAndDelete(ptrLeaderKey, s.config.Instance, 0)
+			close(lost)
+			return
+		case <-t.C:
+			if _, err := s.client.CompareAndSwap(ptrLeaderKey, s.config.Instance, ptrLeaderTTL, s.config.Instance, 0); err != nil {
+				log.Printf("error: Failure to refresh %q, no longer maintaining PTR records: %q", ptrLeaderKey, err)
+				close(lost)
+				return
+			}
+		}
+	}
+}
+
+// watchPTR syncs the PTR records with the services and then keeps them
+// current, until lost is closed. After a directory is removed we sync
+// again, as the event does not tell us what was in it.
+func (s *server) watchPTR(lost chan bool) {
+	stop := make(chan bool)
+	go func() {
+		select {
+		case <-s.stop:
+		case <-lost:
+		}
+		close(stop)
+	}()
+	for {
+		r, err := s.client.Get("/skydns", false, true)
+		if err != nil {
+			log.Printf("error: Failure to get services for PTR records: %q", err)
+		} else {
+			s.syncPTR(r.Node)
+			index := r.EtcdIndex + 1
+			for {
+				r, err := s.client.Watch("/skydns", index, true, nil, stop)
+				if err != nil {
+					break
+				}
+				index = r.Node.ModifiedIndex + 1
+				if !s.updatePTR(r) {
+					break
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// syncPTR sets the PTR records for all services in the tree n and removes
+// the PTR records we maintain that no longer belong to a service.
+func (s *server) syncPTR(n *etcd.Node) {
+	want := make(map[string]bool)
+	var have []string
+	var walk func(n *etcd.Node)
+	walk = func(n *etcd.Node) {
+		if n.Dir {
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+			return
+		}
+		if strings.HasPrefix(pathpkg.Base(n.Key), ptrPrefix) {
+			have = append(have, n.Key)
+			return
+		}
+		if ip := s.ptrAddress(n); ip != nil {
+			if key := s.setPTR(n, ip); key != "" {
+				want[key] = true
+			}
+		}
+	}
+	walk(n)
+	for _, key := range have {
+		if want[key] {
+			continue
+		}
+		if _, err := s.client.Delete(key, false); err != nil && backendError(err) != ErrNotFound {
+			log.Printf("error: Failure to remove PTR record %q: %q", key, err)
+		}
+	}
+}
+
+// updatePTR applies a single watch event to the PTR records. It returns false
+// when the PTR records must be synced again, because a directory was removed.
+func (s *server) updatePTR(r *etcd.Response) bool {
+	if r.Node == nil {
+		return true
+	}
+	var old net.IP
+	if r.PrevNode != nil {
+		if r.PrevNode.Dir {
+			switch r.Action {
+			case "delete", "compareAndDelete", "expire":
+				return false
+			}
+			return true
+		}
+		old = s.ptrAddress(r.PrevNode)
+	}
+	if r.Node.Dir {
+		return true
+	}
+	switch r.Action {
+	case "delete", "compareAndDelete", "expire":
+		if old != nil {
+			s.deletePTR(r.Node.Key, old)
+		}
+	default: // set, create, update, compareAndSwap
+		ip := s.ptrAddress(r.Node)
+		if old != nil && !old.Equal(ip) {
+			s.deletePTR(r.Node.Key, old)
+		}
+		if ip != nil {
+			s.setPTR(r.Node, ip)
+		}
+	}
+	return true
+}
+
+// ptrAddress returns the address of the service in n when it needs a PTR
+// record, or nil. Names in the reverse tree itself and keys outside our
+// domains (config, overrides) are skipped.
+func (s *server) ptrAddress(n *etcd.Node) net.IP {
+	name := ownerName(n.Key)
+	if strings.HasSuffix(name, ".arpa.") || s.zoneOf(name) == "" {
+		return nil
+	}
+	serv := new(Service)
+	if err := json.Unmarshal([]byte(n.Value), serv); err != nil || serv.NS {
+		return nil
+	}
+	return net.ParseIP(serv.Host)
+}
+
+// setPTR sets the PTR record for the service in n, with the same TTL, and
+// returns its key, or "" when it could not be set.
+func (s *server) setPTR(n *etcd.Node, ip net.IP) string {
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return ""
+	}
+	// The PTR record is limited to the same views as the service.
+	serv := new(Service)
+	json.Unmarshal([]byte(n.Value), serv)
+	value, err := json.Marshal(&Service{RR: fmt.Sprintf("%s PTR %s", reverse, ownerName(n.Key)), Views: serv.Views})
+	if err != nil {
+		return ""
+	}
+	ttl := uint64(0)
+	if n.TTL > 0 {
+		ttl = uint64(n.TTL)
+	}
+	key := ptrKey(n.Key, reverse)
+	if _, err := s.client.Set(key, string(value), ttl); err != nil {
+		log.Printf("error: Failure to set PTR record for %q: %q", n.Key, err)
+		return ""
+	}
+	return key
+}
+
+// deletePTR removes the PTR record for ip of the service at key.
+func (s *server) deletePTR(key string, ip net.IP) {
+	reverse, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return
+	}
+	if _, err := s.client.Delete(ptrKey(key, reverse), false); err != nil && backendError(err) != ErrNotFound {
+		log.Printf("error: Failure to remove PTR record for %q: %q", key, err)
+	}
+}
+
+// ptrKey returns the key of the PTR record for the service at key, below the
+// reverse name. Each service gets its own, as services can share an address.
+func ptrKey(key, reverse string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%s/%s%08x", path(reverse), ptrPrefix, h.Sum32())
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// queryRecord is a single entry in the query log.
+type queryRecord struct {
+	Time    time.Time `json:"time"`
+	Name    string    `json:"qname"`
+	Type    string    `json:"qtype"`
+	Client  string    `json:"client"`
+	Rcode   string    `json:"rcode"`
+	Latency float64   `json:"latency"` // in seconds
+	Cached  bool      `json:"cached"`  // answered from the in-memory zone
+}
+
+// queryLogger writes queryRecords as JSON, one per line, to a file or to
+// stderr. Only a sample of the queries is logged. When the file gets
+// larger than max bytes it is moved to file.1 and a new one is started.
+type queryLogger struct {
+	sync.Mutex
+	file   string
+	max    int64
+	sample float64
+	w      io.Writer
+	f      *os.File
+	size   int64
+}
+
+// newQueryLogger returns a queryLogger writing to file, "-" is stderr.
+func newQueryLogger(file string, max int64, sample float64) (*queryLogger, error) {
+	q := &queryLogger{file: file, max: max, sample: sample}
+	if file == "-" {
+		q.w = os.Stderr
+		return q, nil
+	}
+	if err := q.open(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *queryLogger) open() error {
+	f, err := os.OpenFile(q.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	q.f, q.w, q.size = f, f, fi.Size()
+	return nil
+}
+
+// rotate moves the current file to file.1 and opens a new one. If moving
+// fails, we continue with the current file.
+func (q *queryLogger) rotate() error {
+	q.f.Close()
+	err := os.Rename(q.file, q.file+".1")
+	if err1 := q.open(); err1 != nil {
+		q.f, q.w = nil, ioutil.Discard
+		return err1
+	}
+	return err
+}
+
+// log writes r to the log, if it is part of the sample.
+func (q *queryLogger) log(r *queryRecord) {
+	if q.sample < 1 && rand.Float64() >= q.sample {
+		return
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	buf = append(buf, '\n')
+	q.Lock()
+	defer q.Unlock()
+	if q.f != nil && q.max > 0 && q.size+int64(len(buf)) > q.max {
+		if err := q.rotate(); err != nil {
+			logf("error: Failure to rotate query log: %q", err)
+		}
+	}
+	n, _ := q.w.Write(buf)
+	q.size += int64(n)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// replay sends the queries in the query log file to both reference and
+// shadow, and logs the queries that get a different answer. It returns the
+// number of queries and the number of differences.
+func replay(file, reference, shadow string, timeout time.Duration) (queries, diffs int, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	c := &dns.Client{ReadTimeout: timeout}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := new(queryRecord)
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			log.Printf("replay: skipping %q: %s", scanner.Text(), err)
+			continue
+		}
+		qtype, ok := parseType(r.Type)
+		if !ok {
+			log.Printf("replay: skipping %q: unknown type %q", r.Name, r.Type)
+			continue
+		}
+		queries++
+		a := replayQuery(c, reference, r.Name, qtype)
+		b := replayQuery(c, shadow, r.Name, qtype)
+		if a != b {
+			diffs++
+			log.Printf("replay: %q %s: %s: %s, %s: %s", r.Name, r.Type, reference, a, shadow, b)
+		}
+	}
+	return queries, diffs, scanner.Err()
+}
+
+// replayQuery sends a query for name and qtype to addr and returns the
+// answer in a form that can be compared: the rcode and the sorted answer
+// section, without the TTLs.
+func replayQuery(c *dns.Client, addr, name string, qtype uint16) string {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	answer := make([]string, len(r.Answer))
+	for i, rr := range r.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		answer[i] = rr.String()
+	}
+	sort.Strings(answer)
+	return fmt.Sprintf("%s [%s]", dns.RcodeToString[r.Rcode], strings.Join(answer, ", "))
+}
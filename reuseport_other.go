@@ -0,0 +1,18 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort is only supported on Linux.
+func listenReusePort(addr string) (net.PacketConn, error) {
+	return nil, errors.New("SO_REUSEPORT is only supported on Linux")
+}
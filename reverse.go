@@ -0,0 +1,96 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PTRRecords returns PTR records for the names in the hosts files and the
+// services that have the address in the reverse name in q as their Host.
+// The latter are the records kept in etcd with AutoPTR, or else need the
+// in-memory zone, so only work with Preload. In our reverse zones the
+// records in etcd are already found by GenericRecords. Only services visible
+// in view get a PTR record.
+func (s *server) PTRRecords(q dns.Question, view string) (records []dns.RR) {
+	ip := reverseIP(q.Name)
+	if ip == nil {
+		return nil
+	}
+	if s.config.hosts != nil {
+		for _, n := range s.config.hosts.reverse(ip) {
+			records = append(records, &dns.PTR{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: s.settings().minTtl},
+				Ptr: n})
+		}
+	}
+	if s.config.AutoPTR {
+		if s.zoneOf(q.Name) != "" {
+			return records
+		}
+		rs, err := s.GenericRecords(q, view)
+		if err != nil && err != ErrNotFound {
+			logf("error: Failure to get PTR records for %q: %q", q.Name, err)
+		}
+		return append(records, rs...)
+	}
+	if s.zone == nil {
+		return records
+	}
+	for _, key := range s.zone.Reverse(ip) {
+		ttl := s.settings().ttl
+		if r, err := s.zone.Get(key); err == nil {
+			if serv, err := s.newService(r.Node); err == nil {
+				if !serv.visibleTo(view) {
+					continue
+				}
+				ttl = serv.ttl
+			}
+		}
+		records = append(records, &dns.PTR{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: domain(key)})
+		s.logSource(records[len(records)-1], key)
+	}
+	return records
+}
+
+// reverseIP returns the address in the reverse name (in in-addr.arpa. or
+// ip6.arpa.), or nil when name is not a complete reverse name.
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		l := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(l) != 4 {
+			return nil
+		}
+		for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+			l[i], l[j] = l[j], l[i]
+		}
+		return net.ParseIP(strings.Join(l, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		l := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(l) != 32 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i := 0; i < 32; i++ {
+			n, err := strconv.ParseUint(l[31-i], 16, 8)
+			if err != nil || len(l[31-i]) != 1 {
+				return nil
+			}
+			if i%2 == 0 {
+				ip[i/2] = byte(n) << 4
+			} else {
+				ip[i/2] |= byte(n)
+			}
+		}
+		return ip
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// selfTest queries the running server for the SOA record, for a canary
+// record that is injected into etcd and for a name that must be forwarded.
+// It returns the first check that fails.
+func selfTest(s *server) error {
+	addrs := s.config.listenAddrs("udp")
+	if len(addrs) == 0 {
+		return fmt.Errorf("no UDP address to query")
+	}
+	addr := selfTestAddr(addrs[0])
+	c := &dns.Client{ReadTimeout: s.config.ReadTimeout}
+
+	// SOA, we retry until the server is up and running.
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = selfTestQuery(c, addr, s.config.Domain, dns.TypeSOA, dns.RcodeSuccess); err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("SOA: %s", err)
+	}
+	log.Printf("selftest: SOA: ok")
+
+	// Canary.
+	name := "canary-" + strconv.Itoa(int(dns.Id())) + ".selftest." + s.config.Domain
+	value, _ := json.Marshal(&Service{Host: "127.0.0.1", Port: 0})
+	if _, err := s.client.Set(path(name), string(value), 60); err != nil {
+		return fmt.Errorf("canary: %s", err)
+	}
+	defer s.client.Delete(path(name), false)
+	for i := 0; i < 10; i++ {
+		if err = selfTestQuery(c, addr, name, dns.TypeA, dns.RcodeSuccess); err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("canary: %s", err)
+	}
+	log.Printf("selftest: canary: ok")
+
+	// Forwarding.
+	if len(s.settings().nameservers) == 0 {
+		log.Printf("selftest: forward: skipped, no nameservers configured")
+		return nil
+	}
+	if err := selfTestQuery(c, addr, ".", dns.TypeSOA, dns.RcodeSuccess); err != nil {
+		return fmt.Errorf("forward: %s", err)
+	}
+	log.Printf("selftest: forward: ok")
+	return nil
+}
+
+// selfTestQuery sends a query for name and qtype to addr and checks the rcode
+// and that we got an answer.
+func selfTestQuery(c *dns.Client, addr, name string, qtype uint16, rcode int) error {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != rcode {
+		return fmt.Errorf("expected rcode %s, got %s", dns.RcodeToString[rcode], dns.RcodeToString[r.Rcode])
+	}
+	if len(r.Answer) == 0 {
+		return fmt.Errorf("no answer for %s", name)
+	}
+	return nil
+}
+
+// selfTestAddr returns an address we can send queries to, when listening
+// on all addresses we use the loopback address.
+func selfTestAddr(addr string) string {
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(h); ip == nil || ip.IsUnspecified() {
+		h = "127.0.0.1"
+	}
+	return net.JoinHostPort(h, p)
+}
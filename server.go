@@ -6,12 +6,19 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"math"
+	"math/rand"
 	"net"
-	"net/url"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-etcd/etcd"
@@ -19,25 +26,111 @@ import (
 )
 
 type server struct {
-	domainLabels int
-	client       *etcd.Client
-	config       *Config
-	Ttl          uint32
-	MinTtl       uint32
+	client    *etcd.Client
+	config    *Config
+	zone      *zone
+	warmup    *warmup
+	malformed *malformed
+	rtt       *rtts
+	health    *health
+	checker   *checker
+	machines  *machineAddrs
+	stale     *staleCache
+	fstale    *forwardCache
+	keyLock   sync.RWMutex
+	dnskey    *dnssecKey
+	querylog  *queryLogger
+	post      *postProcessor
+	mirror    *mirror
+	snap      *etcd.Node // snapshot to start from when etcd is unreachable
+
+	settingsLock sync.RWMutex
+	current      *settings
+	overrides    *overrides
+	frozen       *frozen
+
+	randLock sync.Mutex
+	rand     *rand.Rand // for the round robin shuffle
+
+	// Used by Stop.
+	stopLock  sync.RWMutex
+	stopping  bool
+	stop      chan bool // closed when stopping
+	inflight  sync.WaitGroup
+	listeners []*dns.Server
 }
 
-// Newserver returns a new server.
+// NewServer returns a new server, start it with Run and stop it with Stop.
+// These live in package main for now, so SkyDNS can't be imported.
 func NewServer(config *Config, client *etcd.Client) *server {
 	s := &server{
-		client: client,
-		config: config,
-		Ttl:    3600,
-		MinTtl: 60,
+		client:    client,
+		config:    config,
+		current:   newSettings(config),
+		overrides: &overrides{},
+		frozen:    &frozen{},
+		rtt:       newRtts(),
+		health:    newHealth(),
+		machines:  new(machineAddrs),
+		dnskey:    config.key,
+		stop:      make(chan bool),
+	}
+	flatKeys = config.FlatKeys
+	setConfigHash(config)
+	if config.Mirror != "" {
+		s.mirror = newMirror(config.Mirror, config.MirrorSample)
+	}
+	if config.PostProcess != "" {
+		s.post = newPostProcessor(config.PostProcess, config.PostProcessTimeout)
+	}
+	seed := time.Now().UnixNano()
+	if config.Seed != 0 {
+		seed = config.Seed
+	}
+	s.rand = rand.New(rand.NewSource(seed))
+	logger.setLimit(config.LogLimit)
+	s.malformed = newMalformed(config.MalformedThreshold)
+	cache.setCapacity(config.SCache)
+	if config.QueryLog != "" {
+		q, err := newQueryLogger(config.QueryLog, int64(config.QueryLogSize)<<20, config.QueryLogSample)
+		if err != nil {
+			log.Printf("error: Failure to open query log: %q", err)
+		}
+		s.querylog = q
+	}
+	if config.MaxStale > 0 && !config.Preload {
+		s.stale = newStaleCache(config.MaxStale)
+	}
+	if config.ForwardStale > 0 {
+		s.fstale = newForwardCache(config.ForwardStale)
+	}
+	if config.WarmUp > 0 {
+		s.warmup = newWarmup(config.WarmUp)
+	}
+	if config.CheckInterval > 0 {
+		s.checker = newChecker(config.CheckInterval)
 	}
 	return s
 }
 
-// Run is a blocking operation that starts the server listening on the DNS ports
+// settings returns the current runtime settings.
+func (s *server) settings() *settings {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.current
+}
+
+// setSettings replaces the runtime settings, queries in flight keep using
+// the old ones.
+func (s *server) setSettings(c *settings) {
+	s.settingsLock.Lock()
+	s.current = c
+	s.settingsLock.Unlock()
+}
+
+// Run is a blocking operation that starts the server listening on the DNS ports.
+// It returns when all listeners are done, or with the first error that
+// prevents us from serving, after stopping the server.
 func (s *server) Run() error {
 	var (
 		group = &sync.WaitGroup{}
@@ -45,42 +138,322 @@ func (s *server) Run() error {
 	)
 	mux.Handle(".", s)
 
-	group.Add(2)
-	go runDNSServer(group, mux, "tcp", s.config.DnsAddr, 0, s.config.WriteTimeout, s.config.ReadTimeout)
-	go runDNSServer(group, mux, "udp", s.config.DnsAddr, 0, s.config.WriteTimeout, s.config.ReadTimeout)
+	// s.zone is set before the goroutines that read it are started.
+	switch {
+	case s.snap != nil:
+		// Serve from the snapshot, watch reloads the zone when etcd returns.
+		s.zone = newZone(s.client, s.config.Grace)
+		s.zone.restore(s.snap, 0)
+		go s.zone.watch(s.stop)
+		go s.zone.sweep(s.stop)
+	case s.config.Preload:
+		s.zone = newZone(s.client, s.config.Grace)
+		if err := s.zone.load(); err != nil {
+			return err
+		}
+		go s.zone.watch(s.stop)
+		go s.zone.sweep(s.stop)
+	}
 
-	group.Wait()
+	s.machines.resolve(s.client.GetCluster())
+	go s.refreshMachines(time.Minute)
+	if s.stale != nil {
+		go s.stale.sweep(s.stop)
+	}
+	if s.fstale != nil {
+		go s.fstale.sweep(s.stop)
+	}
+	go s.watchConfig()
+	go s.watchOverrides()
+	go s.watchFrozen()
+	if s.mirror != nil {
+		go s.mirror.run(s.stop)
+	}
+	if s.config.ZoneStats > 0 {
+		go s.zoneStats(s.config.ZoneStats)
+	}
+	if s.config.AutoPTR {
+		go s.maintainPTR()
+	}
+	if s.warmup != nil {
+		go s.warmup.watch(s.client, s.stop)
+	}
+	if s.config.hosts != nil {
+		go s.config.hosts.watch(10*time.Second, s.stop)
+	}
+	if s.config.Docker != "" {
+		go newDockerSync(s).run()
+	}
+	if s.config.Marathon != "" {
+		go newMarathonSync(s).run()
+	}
+
+	// fatal receives the first error that stops us from serving.
+	fatal := make(chan error, 1)
+	var failed, listeners int32
+	for _, n := range []string{"tcp", "udp"} {
+		for _, addr := range s.config.listenAddrs(n) {
+			listeners++
+			group.Add(1)
+			go func(n, addr string) {
+				defer group.Done()
+				var err error
+				if n == "udp" && s.config.UDPWorkers > 1 {
+					err = s.runUDPWorkers(mux, addr)
+				} else {
+					err = runDNSServer(mux, n, addr, 0, s.config.WriteTimeout, s.config.ReadTimeout, s.config.TsigSecret, s.config.ListenRetries, false, s.addListener)
+				}
+				if err == nil || s.stopped() {
+					return
+				}
+				statsListenFailureCount.Add(1)
+				if !s.config.ListenDegrade {
+					select {
+					case fatal <- err:
+					default:
+					}
+					return
+				}
+				log.Printf("error: Failure to serve %s on %q, continuing without it: %q", n, addr, err)
+				atomic.AddInt32(&failed, 1)
+			}(n, addr)
+		}
+	}
+	if s.config.HttpAddr != "" {
+		go func() {
+			if err := runHTTPServer(s); err != nil {
+				select {
+				case fatal <- err:
+				default:
+				}
+			}
+		}()
+	}
+	if s.config.CanaryInterval > 0 {
+		go s.canary()
+	}
+	if s.config.ForwardCheck > 0 {
+		go s.checkNameservers()
+	}
+	if s.checker != nil {
+		go s.checker.run(s.stop)
+	}
+
+	done := make(chan bool)
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case err := <-fatal:
+		s.Stop(s.config.ReadTimeout)
+		return err
+	case <-done:
+	}
+	if failed == listeners {
+		return fmt.Errorf("failure to serve on %q", s.config.DnsAddr)
+	}
 	return nil
 }
 
-func runDNSServer(group *sync.WaitGroup, mux *dns.ServeMux, net, addr string, udpsize int, writeTimeout, readTimeout time.Duration) {
-	defer group.Done()
+// Stop stops the server: new queries are no longer accepted, the queries in
+// flight are given until timeout to finish, then the listeners and the etcd
+// watches are closed. An error is returned when the queries didn't finish
+// in time.
+func (s *server) Stop(timeout time.Duration) error {
+	s.stopLock.Lock()
+	if s.stopping {
+		s.stopLock.Unlock()
+		return nil
+	}
+	s.stopping = true
+	listeners := s.listeners
+	s.stopLock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("queries still in flight after %s", timeout)
+	}
+	for _, l := range listeners {
+		l.Shutdown()
+	}
+	close(s.stop)
+	return err
+}
+
+// stopped returns true when Stop has been called.
+func (s *server) stopped() bool {
+	s.stopLock.RLock()
+	defer s.stopLock.RUnlock()
+	return s.stopping
+}
+
+// addListener registers a DNS server, so Stop can shut it down.
+func (s *server) addListener(l *dns.Server) {
+	s.stopLock.Lock()
+	defer s.stopLock.Unlock()
+	s.listeners = append(s.listeners, l)
+}
+
+// runUDPWorkers serves UDP on addr with UDPWorkers sockets that share the
+// address with SO_REUSEPORT, each with its own read loop. It returns when all
+// of them are done, with the first error.
+func (s *server) runUDPWorkers(mux *dns.ServeMux, addr string) error {
+	errs := make(chan error, s.config.UDPWorkers)
+	for i := 0; i < s.config.UDPWorkers; i++ {
+		go func() {
+			errs <- runDNSServer(mux, "udp", addr, 0, s.config.WriteTimeout, s.config.ReadTimeout, s.config.TsigSecret, s.config.ListenRetries, true, s.addListener)
+		}()
+	}
+	var err error
+	for i := 0; i < s.config.UDPWorkers; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
 
-	server := &dns.Server{
-		Addr:         addr,
-		Net:          net,
-		Handler:      mux,
-		UDPSize:      udpsize,
-		ReadTimeout:  readTimeout,
-		WriteTimeout: writeTimeout,
+// runDNSServer runs a DNS server on net and addr. When the address is in use
+// we retry, with an exponential backoff, for retries times. With reuseport
+// the UDP socket is opened with SO_REUSEPORT. Each server that is created is
+// passed to started.
+func runDNSServer(mux *dns.ServeMux, net, addr string, udpsize int, writeTimeout, readTimeout time.Duration, tsigSecret map[string]string, retries int, reuseport bool, started func(*dns.Server)) error {
+	backoff := 100 * time.Millisecond
+	for i := 0; ; i++ {
+		server := &dns.Server{
+			Addr:         addr,
+			Net:          net,
+			Handler:      mux,
+			UDPSize:      udpsize,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			TsigSecret:   tsigSecret,
+		}
+		started(server)
+		var err error
+		if reuseport {
+			if server.PacketConn, err = listenReusePort(addr); err == nil {
+				err = server.ActivateAndServe()
+			}
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err == nil {
+			return nil
+		}
+		if !isAddrInUse(err) || i >= retries {
+			return err
+		}
+		log.Printf("error: Failure to listen on %s %q: %q, retrying in %s", net, addr, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+}
+
+// isAddrInUse returns true when err is caused by the address being in use.
+func isAddrInUse(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		if se, ok := op.Err.(*os.SyscallError); ok {
+			return se.Err == syscall.EADDRINUSE
+		}
 	}
+	return false
 }
 
 // ServeDNS is the handler for DNS requests, responsible for parsing DNS request, possibly forwarding
 // it to a real dns server and returning a response.
 func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	//stats.RequestCount.Inc(1)
+	s.stopLock.RLock()
+	if s.stopping {
+		s.stopLock.RUnlock()
+		return
+	}
+	s.inflight.Add(1)
+	s.stopLock.RUnlock()
+	defer s.inflight.Done()
+	start := time.Now()
+	if s.mirror != nil {
+		s.mirror.add(req)
+	}
+
+	statsRequestCount.Add(1)
+	t := s.newQueryTimer()
+	w = s.counted(w, req)
+	key := tsigKey(w, req)
+	if key != "" {
+		w = &tsigWriter{ResponseWriter: w, t: req.IsTsig()}
+	}
 
+	if !s.queryAllowed(remoteIP(w), key) {
+		s.ServeDNSRefused(w, req)
+		return
+	}
+	// Zero questions is always an error, more than one is only allowed when
+	// MultiQuestion is set, we then answer the first.
+	if len(req.Question) == 0 || (len(req.Question) > 1 && !s.config.MultiQuestion) {
+		s.ServeDNSFormatError(w, req)
+		return
+	}
+	if req.Opcode == dns.OpcodeUpdate {
+		s.ServeDNSUpdate(w, req)
+		return
+	}
 	q := req.Question[0]
 	name := strings.ToLower(q.Name)
 
-	log.Printf("Received DNS Request for %q from %q with type %d", q.Name, w.RemoteAddr(), q.Qtype)
+	if s.config.allowedTypes != nil && !s.config.allowedTypes[q.Qtype] {
+		s.ServeDNSNotAllowed(w, req)
+		return
+	}
 
-	if !strings.HasSuffix(name, s.config.Domain) {
+	zone := s.zoneOf(name)
+	if zone == "" {
+		// Names from the hosts files and the reverse index are answered by us.
+		var (
+			records []dns.RR
+			from    string
+		)
+		switch q.Qtype {
+		case dns.TypePTR:
+			records, from = s.PTRRecords(q, key), originZone
+		case dns.TypeA, dns.TypeAAAA:
+			records, from = s.hostsRecords(q), originHosts
+		}
+		if len(records) > 0 {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Authoritative = true
+			m.RecursionAvailable = true
+			m.CheckingDisabled = req.CheckingDisabled
+			m.Answer = records
+			s.origin(m, req, from)
+			w.WriteMsg(m)
+			return
+		}
+		if s.ServeDNSSpecialUse(w, req) {
+			return
+		}
+		if !s.forwardAllowed(remoteIP(w), key) {
+			s.ServeDNSRefused(w, req)
+			return
+		}
+		t.mark("setup")
 		s.ServeDNSForward(w, req)
+		t.mark("forward")
+		t.log(q)
+		return
+	}
+
+	if q.Qtype == dns.TypeAXFR {
+		s.ServeDNSTransfer(w, req)
 		return
 	}
 
@@ -88,68 +461,293 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	m.SetReply(req)
 	m.Authoritative = true
 	m.RecursionAvailable = true
+	m.CheckingDisabled = req.CheckingDisabled // RFC 4035, section 3.1.6
 	m.Answer = make([]dns.RR, 0, 10)
+	k := s.keyFor(zone)
+	t.mark("setup")
 	defer func() {
+		t.mark("lookup/" + s.localOrigin())
+		if s.post != nil {
+			s.postProcess(w, req, m)
+			t.mark("post")
+		}
+		if s.config.Dedup {
+			dedup(m)
+		}
 		// Check if we need to do DNSSEC and sign the reply.
-		if s.config.PubKey != nil {
+		if k != nil {
 			if opt := req.IsEdns0(); opt != nil && opt.Do() {
-				s.nsec(m)
-				s.sign(m, opt.UDPSize())
+				s.nsec(m, key)
+				s.sign(m, opt.UDPSize(), k)
+				t.mark("sign")
 			}
 		}
+		s.origin(m, req, s.localOrigin())
+		s.compress(m)
+		s.truncate(w, req, m)
 		w.WriteMsg(m)
+		t.mark("write")
+		t.log(q)
 	}()
 
-	if name == s.config.Domain {
-		switch q.Qtype {
-		case dns.TypeDNSKEY:
-			if s.config.PubKey != nil {
-				m.Answer = append(m.Answer, s.config.PubKey)
-				return
-			}
-		case dns.TypeSOA:
-			m.Answer = []dns.RR{s.SOA()}
-			return
+	if records := s.staticRecords(q); len(records) > 0 {
+		m.Answer = append(m.Answer, records...)
+		return
+	}
+	if name == zone {
+		if err := s.apex(m, q, k, key); err != nil {
+			s.backendFailure(m, req, err)
 		}
+		return
 	}
 	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-		records, err := s.AddressRecords(q)
+		records, err := s.AddressRecords(q, key)
 		if err != nil {
-			m.SetRcode(req, dns.RcodeNameError)
-			m.Ns = []dns.RR{s.SOA()}
+			s.backendFailure(m, req, err)
 			return
 		}
+		records = s.geoSort(records, clientIP(w, req), name)
 		m.Answer = append(m.Answer, records...)
 	}
+	if s.overtime(start, m, req) {
+		return
+	}
 	if q.Qtype == dns.TypeSRV || q.Qtype == dns.TypeANY {
-		records, extra, err := s.SRVRecords(q)
-		if err != nil {
-			// NODATA
+		records, extra, err := s.SRVRecords(q, key)
+		if err != nil && err != ErrNotFound {
+			s.backendFailure(m, req, err)
+			return
+		}
+		m.Answer = append(m.Answer, records...)
+		m.Extra = append(m.Extra, s.limitExtra(extra, s.config.MaxExtra)...)
+	}
+	if s.overtime(start, m, req) {
+		return
+	}
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		records, err := s.TXTRecords(q, key)
+		if err != nil && err != ErrNotFound {
+			s.backendFailure(m, req, err)
+			return
 		}
 		m.Answer = append(m.Answer, records...)
-		m.Extra = append(m.Extra, extra...)
 	}
-	// FIXME(miek): uh, NXDOMAIN or NODATA?
+	if s.overtime(start, m, req) {
+		return
+	}
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeTXT:
+	default:
+		records, err := s.GenericRecords(q, key)
+		if err != nil && err != ErrNotFound {
+			s.backendFailure(m, req, err)
+			return
+		}
+		m.Answer = append(m.Answer, records...)
+	}
+	if q.Qtype == dns.TypePTR {
+		// In one of our reverse zones.
+		m.Answer = append(m.Answer, s.PTRRecords(q, key)...)
+	}
+	if s.overtime(start, m, req) {
+		return
+	}
+	if len(m.Answer) == 0 && s.referral(m, req) {
+		return
+	}
 	if len(m.Answer) == 0 {
+		if _, err := s.getName(name); err == nil {
+			// The name exists, but not with this type, or it is an empty
+			// non-terminal: NODATA.
+			m.Ns = []dns.RR{s.SOA(zone)}
+			return
+		}
 		// We are authoritative for this name, but it does not exist: NXDOMAIN
 		m.SetRcode(req, dns.RcodeNameError)
-		m.Ns = []dns.RR{s.SOA()}
+		m.Ns = []dns.RR{s.SOA(zone)}
 		return
 	}
+}
+
+// zoneOf returns the domain name is in, the longest one when domains are
+// nested, or "" when name is not in any of our domains.
+func (s *server) zoneOf(name string) string {
+	return s.config.zoneOf(name)
+}
+
+// keyFor returns the DNSSEC key for zone, or nil when it isn't signed.
+func (s *server) keyFor(zone string) *dnssecKey {
+	if zone == s.config.Domain {
+		return s.key()
+	}
+	return s.config.domainKeys[zone]
+}
+
+// apex answers q for one of our domains itself. The apex has the SOA, NS and DNSKEY
+// records and the addresses of the nameservers, ANY returns all of these.
+// With ApexSRV, SRV (and ANY) also return the services of the entire tree
+// that are visible in view. Everything else is NODATA.
+func (s *server) apex(m *dns.Msg, q dns.Question, k *dnssecKey, view string) error {
+	zone := strings.ToLower(q.Name)
+	switch q.Qtype {
+	case dns.TypeSOA:
+		m.Answer = append(m.Answer, s.SOA(zone))
+	case dns.TypeNS:
+		m.Answer = append(m.Answer, s.NS(zone))
+		m.Extra = append(s.nameserverRecords("master."+zone, dns.TypeA), s.nameserverRecords("master."+zone, dns.TypeAAAA)...)
+	case dns.TypeDNSKEY:
+		if k != nil {
+			m.Answer = append(m.Answer, k.pub)
+		}
+	case dns.TypeNSEC3PARAM:
+		if k != nil && s.config.NSEC3 {
+			m.Answer = append(m.Answer, s.NSEC3PARAM(zone))
+		}
+	case dns.TypeA, dns.TypeAAAA:
+		m.Answer = append(m.Answer, s.nameserverRecords(q.Name, q.Qtype)...)
+	case dns.TypeSRV, dns.TypeANY:
+		if q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, s.SOA(zone), s.NS(zone))
+			if k != nil {
+				m.Answer = append(m.Answer, k.pub)
+				if s.config.NSEC3 {
+					m.Answer = append(m.Answer, s.NSEC3PARAM(zone))
+				}
+			}
+			records, err := s.apexRecords(q, view)
+			if err != nil {
+				return err
+			}
+			m.Answer = append(m.Answer, records...)
+		}
+		if !s.config.ApexSRV {
+			// Don't enumerate the entire tree.
+			break
+		}
+		records, extra, err := s.SRVRecords(q, view)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		m.Answer = append(m.Answer, records...)
+		m.Extra = append(m.Extra, s.limitExtra(extra, s.config.MaxExtra)...)
+	default:
+		records, err := s.apexRecords(q, view)
+		if err != nil {
+			return err
+		}
+		m.Answer = append(m.Answer, records...)
+	}
 	if len(m.Answer) == 0 { // Send back a NODATA response
-		m.Ns = []dns.RR{s.SOA()}
+		m.Ns = []dns.RR{s.SOA(zone)}
 	}
+	return nil
+}
+
+// apexRecords returns the TXT records (SPF, site verification, ...) and the
+// records from the RR field of the services stored under the @ key of the
+// zone, i.e. /skydns/local/skydns/@ for skydns.local. The apex itself can't
+// hold these, as it is the directory of the entire zone.
+func (s *server) apexRecords(q dns.Question, view string) (records []dns.RR, err error) {
+	aq := dns.Question{Name: "@." + q.Name, Qtype: q.Qtype, Qclass: q.Qclass}
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		records, err = s.TXTRecords(aq, view)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+	if q.Qtype != dns.TypeTXT {
+		generic, err := s.GenericRecords(aq, view)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		records = append(records, generic...)
+	}
+	for _, r := range records {
+		r.Header().Name = q.Name
+	}
+	return records, nil
+}
+
+// ownerName returns the name owning the records of the service at key. This
+// is the name of the key, except for the services under the @ key of a zone,
+// which are owned by the apex.
+func ownerName(key string) string {
+	labels := dns.SplitDomainName(domain(key))
+	for i, l := range labels {
+		if l == "@" {
+			return dns.Fqdn(strings.Join(labels[i+1:], "."))
+		}
+	}
+	return domain(key)
+}
+
+// overtime returns true when we have spent more than QueryTimeout on the query
+// that started at start. The reply m then holds the records gathered so far,
+// or is a SERVFAIL when there are none or QueryTimeoutServfail is set.
+func (s *server) overtime(start time.Time, m, req *dns.Msg) bool {
+	if s.config.QueryTimeout == 0 || time.Since(start) < s.config.QueryTimeout {
+		return false
+	}
+	statsQueryTimeoutCount.Add(1)
+	if len(m.Answer) == 0 || s.config.QueryTimeoutServfail {
+		m.SetRcode(req, dns.RcodeServerFailure)
+		m.Answer, m.Extra = nil, nil
+	}
+	return true
+}
+
+// backendFailure sets the rcode in m according to the error returned by the
+// backend: NXDOMAIN for names that do not exist and SERVFAIL otherwise.
+func (s *server) backendFailure(m, req *dns.Msg, err error) {
+	switch err {
+	case ErrNotFound:
+		if s.referral(m, req) {
+			return
+		}
+		m.SetRcode(req, dns.RcodeNameError)
+		m.Ns = []dns.RR{s.SOA(s.zoneOf(req.Question[0].Name))}
+	default:
+		m.SetRcode(req, dns.RcodeServerFailure)
+	}
+}
+
+// ServeDNSFormatError sends back a FORMERR response for packets we can not handle.
+func (s *server) ServeDNSFormatError(w dns.ResponseWriter, req *dns.Msg) {
+	h, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	s.malformed.add(h)
+	m := new(dns.Msg)
+	m.SetRcodeFormatError(req)
+	w.WriteMsg(m)
+}
+
+// ServeDNSNotAllowed answers queries for a type that is not in AllowedTypes,
+// without looking anything up: NODATA for our domain and NOTIMP otherwise.
+func (s *server) ServeDNSNotAllowed(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if zone := s.zoneOf(req.Question[0].Name); zone != "" {
+		m.Authoritative = true
+		m.Ns = []dns.RR{s.SOA(zone)}
+	} else {
+		m.SetRcode(req, dns.RcodeNotImplemented)
+	}
+	w.WriteMsg(m)
 }
 
 // ServeDNSForward forwards a request to a nameservers and returns the response.
+// The request is forwarded as is, so the CD bit is passed upstream, and the
+// CD bit of the reply is set to that of the request.
 func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) {
-	if len(s.config.Nameservers) == 0 {
-		log.Printf("error: Failure to Forward DNS Request, no servers configured %q", dns.ErrServ)
+	w = timed(w, req, statsForwardDuration)
+	settings := s.settingsFor(req.Question[0].Name)
+	if len(settings.nameservers) == 0 {
+		logf("error: Failure to Forward DNS Request, no servers configured %q", dns.ErrServ)
 		m := new(dns.Msg)
 		m.SetReply(req)
 		m.SetRcode(req, dns.RcodeServerFailure)
 		m.Authoritative = false     // no matter what set to false
 		m.RecursionAvailable = true // and this is still true
+		m.CheckingDisabled = req.CheckingDisabled
 		w.WriteMsg(m)
 		return
 	}
@@ -159,228 +757,795 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	c := &dns.Client{Net: network, ReadTimeout: s.config.ReadTimeout}
+	nameservers := s.health.alive(settings.nameservers)
+
+	if s.config.ForwardRace > 0 {
+		r, ns, err := s.forwardRace(c, req, s.rtt.fastest(nameservers, s.config.ForwardRace))
+		if err == nil {
+			log.Printf("Forwarded DNS Request %q to %q", req.Question[0].Name, ns)
+			s.forwarded(w, req, r)
+			return
+		}
+		logf("error: Failure to Forward DNS Request %q", err)
+		s.forwardFailed(w, req)
+		return
+	}
 
 	// Use request Id for "random" nameserver selection
-	nsid := int(req.Id) % len(s.config.Nameservers)
+	nsid := int(req.Id) % len(nameservers)
 	try := 0
 Redo:
-	r, _, err := c.Exchange(req, s.config.Nameservers[nsid])
+	r, rtt, err := c.Exchange(req, nameservers[nsid])
+	s.rtt.update(nameservers[nsid], rtt, err, s.config.ReadTimeout)
 	if err == nil {
-		log.Printf("Forwarded DNS Request %q to %q", req.Question[0].Name, s.config.Nameservers[nsid])
-		w.WriteMsg(r)
+		log.Printf("Forwarded DNS Request %q to %q", req.Question[0].Name, nameservers[nsid])
+		s.forwarded(w, req, r)
 		return
 	}
 	// Seen an error, this can only mean, "server not reached", try again
 	// but only if we have not exausted our nameservers
-	if try < len(s.config.Nameservers) {
-		log.Printf("error: Failure to Forward DNS Request %q to %q", err, s.config.Nameservers[nsid])
+	if try < len(nameservers) {
+		logf("error: Failure to Forward DNS Request %q to %q", err, nameservers[nsid])
 		try++
-		nsid = (nsid + 1) % len(s.config.Nameservers)
+		nsid = (nsid + 1) % len(nameservers)
 		goto Redo
 	}
 
-	log.Printf("error: Failure to Forward DNS Request %q", err)
+	logf("error: Failure to Forward DNS Request %q", err)
+	s.forwardFailed(w, req)
+}
+
+// forwarded writes the reply r to the forwarded request req.
+func (s *server) forwarded(w dns.ResponseWriter, req, r *dns.Msg) {
+	if s.fstale != nil {
+		s.fstale.set(req, r)
+	}
+	r.CheckingDisabled = req.CheckingDisabled
+	s.origin(r, req, originForward)
+	w.WriteMsg(r)
+}
+
+// forwardFailed replies to req when none of the nameservers responded: with
+// the last good reply when ForwardStale is set, otherwise with SERVFAIL.
+func (s *server) forwardFailed(w dns.ResponseWriter, req *dns.Msg) {
+	if s.fstale != nil {
+		if m := s.fstale.get(req); m != nil {
+			statsForwardStaleCount.Add(1)
+			m.CheckingDisabled = req.CheckingDisabled
+			s.origin(m, req, originForward)
+			w.WriteMsg(m)
+			return
+		}
+	}
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.SetRcode(req, dns.RcodeServerFailure)
+	m.CheckingDisabled = req.CheckingDisabled
 	w.WriteMsg(m)
 }
 
-func (s *server) AddressRecords(q dns.Question) (records []dns.RR, err error) {
+// staticRecords returns the records of type q.Qtype for q.Name from the
+// static_records in the config.
+func (s *server) staticRecords(q dns.Question) (records []dns.RR) {
+	for _, rr := range s.settings().static[strings.ToLower(q.Name)] {
+		if rr.Header().Rrtype == q.Qtype {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+func (s *server) AddressRecords(q dns.Question, view string) (records []dns.RR, err error) {
+	return s.addressRecords(q, view, 0)
+}
+
+// maxCnameDepth limits how many CNAMEs in our domains are followed.
+const maxCnameDepth = 8
+
+// addressRecords returns the A or AAAA records for q, depth is the number of
+// CNAMEs followed to get here.
+func (s *server) addressRecords(q dns.Question, view string, depth int) (records []dns.RR, err error) {
 	name := strings.ToLower(q.Name)
-	if name == "master."+s.config.Domain || name == s.config.Domain {
-		for _, m := range s.client.GetCluster() {
-			u, e := url.Parse(m)
-			if e != nil {
-				continue
-			}
-			h, _, e := net.SplitHostPort(u.Host)
-			if e != nil {
-				continue
-			}
-			ip := net.ParseIP(h)
-			switch {
-			case ip.To4() != nil && q.Qtype == dns.TypeA:
-				records = append(records, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.Ttl}, A: ip.To4()})
-			case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
-				records = append(records, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.Ttl}, AAAA: ip.To16()})
-			}
+	if zone := s.zoneOf(name); name == "master."+zone || name == zone {
+		return s.nameserverRecords(q.Name, q.Qtype), nil
+	}
+	hosts := s.hostsRecords(q)
+	r, err := s.getName(name)
+	if err != nil {
+		if err == ErrNotFound && len(hosts) > 0 {
+			return hosts, nil
 		}
-		return
+		return nil, err
 	}
-	r, err := s.client.Get(path(name), false, true)
+	sx, err := s.services(r, view)
 	if err != nil {
-		println(err.Error())
 		return nil, err
 	}
-	var serv *Service
-	if !r.Node.Dir { // single element
-		if err := json.Unmarshal([]byte(r.Node.Value), &serv); err != nil {
-			log.Printf("error: Failure to parse value: %q", err)
-			return nil, err
-		}
+	sx = s.healthy(sx)
+	records = append(records, hosts...)
+	weights := make([]int, len(hosts), len(hosts)+len(sx))
+	for i := range weights {
+		weights[i] = 1
+	}
+	var stale []dns.RR
+	for _, serv := range sx {
 		ip := net.ParseIP(serv.Host)
-		ttl := uint32(r.Node.TTL)
-		if ttl == 0 {
-			ttl = s.Ttl
-		}
+		var rr dns.RR
 		switch {
 		case ip == nil:
+			// A name with a single service that has a name as Host is a
+			// CNAME, a CNAME can not have other records next to it.
+			if len(sx) == 1 && len(hosts) == 0 && serv.Host != "" && !serv.stale {
+				return s.cnameRecords(q, serv, view, depth), nil
+			}
 		case ip.To4() != nil && q.Qtype == dns.TypeA:
 			a := new(dns.A)
-			a.Hdr = dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+			a.Hdr = dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: serv.ttl}
 			a.A = ip.To4()
-			records = append(records, a)
+			rr = a
 		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
 			aaaa := new(dns.AAAA)
-			aaaa.Hdr = dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+			aaaa.Hdr = dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: serv.ttl}
 			aaaa.AAAA = ip.To16()
-			records = append(records, aaaa)
+			rr = aaaa
 		}
-		return records, nil
+		if rr == nil {
+			continue
+		}
+		s.logSource(rr, serv.key)
+		if serv.stale {
+			stale = append(stale, rr)
+			continue
+		}
+		records = append(records, rr)
+		weights = append(weights, serv.Weight)
 	}
-	for _, serv := range s.loopNodes(&r.Node.Nodes) {
-		ip := net.ParseIP(serv.Host)
-		switch {
-		case ip == nil:
-		case ip.To4() != nil && q.Qtype == dns.TypeA:
-			a := new(dns.A)
-			a.Hdr = dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(r.Node.TTL)}
-			a.A = ip.To4()
-			records = append(records, a)
-		case ip.To4() == nil && q.Qtype == dns.TypeAAAA:
-			aaaa := new(dns.AAAA)
-			aaaa.Hdr = dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(r.Node.TTL)}
-			aaaa.AAAA = ip.To16()
-			records = append(records, aaaa)
+	// Services in their grace period are only used when there is nothing else.
+	if len(records) == 0 && len(stale) > 0 {
+		statsStaleCount.Add(int64(len(stale)))
+		records = stale
+	}
+	max := s.config.MaxAnswers
+	switch {
+	case s.config.AddressWeights && len(records) == len(weights):
+		s.weightedShuffle(records, weights)
+	case s.settingsFor(q.Name).roundRobin || (max > 0 && len(records) > max):
+		s.shuffle(records)
+	}
+	if max > 0 && len(records) > max {
+		records = records[:max]
+	}
+	return records, nil
+}
+
+// namedPort returns the named port, i.e. "http/tcp", and the name below it
+// when name looks like _http._tcp.<name>, otherwise "".
+func namedPort(name string) (string, string) {
+	l := dns.SplitDomainName(name)
+	if len(l) < 3 || !strings.HasPrefix(l[0], "_") || !strings.HasPrefix(l[1], "_") {
+		return "", ""
+	}
+	return l[0][1:] + "/" + l[1][1:], dns.Fqdn(strings.Join(l[2:], "."))
+}
+
+// withPort returns the services in sx that have the named port, with Port
+// set to it.
+func withPort(sx []*Service, port string) []*Service {
+	px := sx[:0]
+	for _, serv := range sx {
+		if p, ok := serv.Ports[port]; ok {
+			serv.Port = p
+			px = append(px, serv)
 		}
 	}
-	if s.config.RoundRobin {
-		switch l := len(records); l {
-		case 2:
-			if dns.Id()%2 == 0 {
-				records[0], records[1] = records[1], records[0]
-			}
-		default:
-			// Do a minimum of l swap, maximum of 4l swaps
-			for j := 0; j < l*(int(dns.Id())%4+1); j++ {
-				q := int(dns.Id()) % l
-				p := int(dns.Id()) % l
-				if q == p {
-					p = (p + 1) % l
-				}
-				records[q], records[p] = records[p], records[q]
-			}
+	return px
+}
+
+// pickServices returns n services from sx, the ones with the lowest
+// priority, picked at random among the services with the same priority.
+func (s *server) pickServices(sx []*Service, n int) []*Service {
+	s.randLock.Lock()
+	for i := len(sx) - 1; i > 0; i-- {
+		j := s.rand.Intn(i + 1)
+		sx[i], sx[j] = sx[j], sx[i]
+	}
+	s.randLock.Unlock()
+	sort.Stable(byPriority(sx))
+	return sx[:n]
+}
+
+// byPriority sorts services by priority, the stale ones last.
+type byPriority []*Service
+
+func (b byPriority) Len() int      { return len(b) }
+func (b byPriority) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byPriority) Less(i, j int) bool {
+	if b[i].stale != b[j].stale {
+		return !b[i].stale
+	}
+	return b[i].Priority < b[j].Priority
+}
+
+// cnameRecords returns the CNAME for q to the Host of serv, followed by the
+// records of the target: looked up by us when it is in our domains, and
+// depending on the CNAMEPolicy with our nameservers when it is not.
+func (s *server) cnameRecords(q dns.Question, serv *Service, view string, depth int) []dns.RR {
+	target := strings.ToLower(dns.Fqdn(serv.Host))
+	records := []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: serv.ttl}, Target: target}}
+	s.logSource(records[0], serv.key)
+	if s.zoneOf(target) != "" {
+		if depth >= maxCnameDepth || target == strings.ToLower(q.Name) {
+			logf("error: CNAME loop at %q", q.Name)
+			return records
+		}
+		more, err := s.addressRecords(dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, view, depth+1)
+		if err == nil {
+			records = append(records, more...)
 		}
+		return records
+	}
+	switch s.config.CNAMEPolicy {
+	case "return":
+		return records
+	case "reject":
+		// Should have been refused when registered.
+		logf("error: CNAME outside our domains at %q", serv.key)
+		return nil
+	}
+	return append(records, s.resolve(target, q.Qtype)...)
+}
+
+// resolve looks up name and qtype with our nameservers and returns the
+// answer, or nil when none of them responds.
+func (s *server) resolve(name string, qtype uint16) []dns.RR {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	c := &dns.Client{ReadTimeout: s.config.ReadTimeout}
+	for _, ns := range s.health.alive(s.settingsFor(name).nameservers) {
+		r, _, err := c.Exchange(m, ns)
+		if err != nil {
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			return nil
+		}
+		return r.Answer
+	}
+	return nil
+}
+
+// weightedShuffle puts records in a random order where a record with a
+// higher weight is more likely to come first. Weights below 1 count as 1.
+func (s *server) weightedShuffle(records []dns.RR, weights []int) {
+	total := 0
+	for i, w := range weights {
+		if w < 1 {
+			weights[i] = 1
+		}
+		total += weights[i]
+	}
+	s.randLock.Lock()
+	defer s.randLock.Unlock()
+	for i := 0; i < len(records)-1; i++ {
+		r := s.rand.Intn(total)
+		j := i
+		for ; r >= weights[j]; j++ {
+			r -= weights[j]
+		}
+		total -= weights[j]
+		records[i], records[j] = records[j], records[i]
+		weights[i], weights[j] = weights[j], weights[i]
+	}
+}
+
+// shuffle puts records in a random order (Fisher-Yates).
+func (s *server) shuffle(records []dns.RR) {
+	s.randLock.Lock()
+	defer s.randLock.Unlock()
+	for i := len(records) - 1; i > 0; i-- {
+		j := s.rand.Intn(i + 1)
+		records[i], records[j] = records[j], records[i]
 	}
-	return records, nil
 }
 
 // SRVRecords returns SRV records from etcd.
 // If the Target is not an name but an IP address, an name is created .
-func (s *server) SRVRecords(q dns.Question) (records []dns.RR, extra []dns.RR, err error) {
+func (s *server) SRVRecords(q dns.Question, view string) (records []dns.RR, extra []dns.RR, err error) {
 	name := strings.ToLower(q.Name)
-	r, err := s.client.Get(path(name), false, true)
+	r, err := s.getName(name)
+	port := ""
+	if err == ErrNotFound {
+		// _service._proto.<name> (RFC 2782), for the services below name
+		// that have this named port.
+		var base string
+		if port, base = namedPort(name); port != "" && (base != s.zoneOf(base) || s.config.ApexSRV) {
+			r, err = s.getName(base)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	sx, err := s.services(r, view)
 	if err != nil {
 		return nil, nil, err
 	}
-	var serv *Service
-	weight := uint16(0)
-	if !r.Node.Dir { // single element
-		if err := json.Unmarshal([]byte(r.Node.Value), &serv); err != nil {
-			log.Printf("error: Failure to parse value: %q", err)
-			return nil, nil, err
+	// The health checks default to the port the service registered.
+	sx = s.healthy(sx)
+	if port != "" {
+		sx = withPort(sx, port)
+	}
+	if name == s.zoneOf(name) && len(sx) > s.config.ApexSRVLimit {
+		sx = sx[:s.config.ApexSRVLimit]
+	}
+	if max := s.config.MaxAnswers; max > 0 && len(sx) > max {
+		sx = s.pickServices(sx, max)
+	}
+	if len(sx) == 0 {
+		return nil, nil, nil
+	}
+	weights := srvWeights(sx)
+	for _, serv := range sx {
+		if serv.Host == "" { // i.e. TXT only
+			continue
 		}
-		ip := net.ParseIP(serv.Host)
-		ttl := uint32(r.Node.TTL)
-		if ttl == 0 {
-			ttl = s.Ttl
+		weight := weights[serv]
+		if s.warmup != nil {
+			weight = s.warmup.weight(serv.key, weight)
 		}
-		switch {
-		case ip == nil:
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
-				Priority: uint16(serv.Priority), Weight: weight, Port: uint16(serv.Port), Target: dns.Fqdn(serv.Host)})
-		case ip.To4() != nil:
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
-				Priority: uint16(serv.Priority), Weight: weight, Port: uint16(serv.Port), Target: domain(r.Node.Key)})
-			extra = append(extra, &dns.A{Hdr: dns.RR_Header{Name: domain(r.Node.Key), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: ip.To4()})
-		case ip.To4() == nil:
-			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
-				Priority: uint16(serv.Priority), Weight: weight, Port: uint16(serv.Port), Target: domain(r.Node.Key)})
-			extra = append(extra, &dns.AAAA{Hdr: dns.RR_Header{Name: domain(r.Node.Key), Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}, AAAA: ip.To16()})
+		priority := uint16(serv.Priority)
+		if serv.stale {
+			// In the grace period, only use this service when nothing else works.
+			statsStaleCount.Add(1)
+			priority, weight = 65535, 0
 		}
-		return records, extra, nil
-	}
-
-	sx := s.loopNodes(&r.Node.Nodes)
-	weight = uint16(math.Floor(float64(100 / len(sx))))
-	for _, serv := range sx {
 		ip := net.ParseIP(serv.Host)
 		switch {
 		case ip == nil:
 			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.ttl},
-				Priority: uint16(serv.Priority), Weight: weight, Port: uint16(serv.Port), Target: dns.Fqdn(serv.Host)})
+				Priority: priority, Weight: weight, Port: uint16(serv.Port), Target: dns.Fqdn(serv.Host)})
 		case ip.To4() != nil:
 			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.ttl},
-				Priority: uint16(serv.Priority), Weight: weight, Port: uint16(serv.Port), Target: domain(serv.key)})
+				Priority: priority, Weight: weight, Port: uint16(serv.Port), Target: domain(serv.key)})
 			extra = append(extra, &dns.A{Hdr: dns.RR_Header{Name: domain(serv.key), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serv.ttl}, A: ip.To4()})
 		case ip.To4() == nil:
 			records = append(records, &dns.SRV{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: serv.ttl},
-				Priority: uint16(serv.Priority), Weight: weight, Port: uint16(serv.Port), Target: domain(serv.key)})
+				Priority: priority, Weight: weight, Port: uint16(serv.Port), Target: domain(serv.key)})
 			extra = append(extra, &dns.AAAA{Hdr: dns.RR_Header{Name: domain(serv.key), Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: serv.ttl}, AAAA: ip.To16()})
 		}
+		s.logSource(records[len(records)-1], serv.key)
 	}
 	return records, extra, nil
 }
 
-// SOA returns a SOA record for this SkyDNS instance.
-func (s *server) SOA() dns.RR {
-	return &dns.SOA{Hdr: dns.RR_Header{Name: s.config.Domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.Ttl},
-		Ns:      "master." + s.config.Domain,
-		Mbox:    "hostmaster." + s.config.Domain,
+// TXTRecords returns TXT records from etcd, for services that have Text set.
+func (s *server) TXTRecords(q dns.Question, view string) (records []dns.RR, err error) {
+	name := strings.ToLower(q.Name)
+	r, err := s.getName(name)
+	if err != nil {
+		return nil, err
+	}
+	sx, err := s.services(r, view)
+	if err != nil {
+		return nil, err
+	}
+	for _, serv := range sx {
+		txt, err := serv.txt()
+		if err != nil {
+			logf("error: Failure to decode text of %q: %q", serv.key, err)
+			continue
+		}
+		if len(txt) == 0 {
+			continue
+		}
+		ttl := serv.ttl
+		if minTtl := s.settingsFor(name).minTtl; strings.HasPrefix(name, "_") && ttl > minTtl {
+			// I.e. ACME challenges, these change often.
+			ttl = minTtl
+		}
+		records = append(records, &dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}, Txt: txt})
+		s.logSource(records[len(records)-1], serv.key)
+	}
+	return records, nil
+}
+
+// GenericRecords returns the records of type q.Qtype (or all, for ANY) from
+// the RR field of the services.
+func (s *server) GenericRecords(q dns.Question, view string) (records []dns.RR, err error) {
+	name := strings.ToLower(q.Name)
+	r, err := s.getName(name)
+	if err != nil {
+		return nil, err
+	}
+	sx, err := s.services(r, view)
+	if err != nil {
+		return nil, err
+	}
+	for _, serv := range sx {
+		if serv.RR == "" {
+			continue
+		}
+		rr, err := dns.NewRR(serv.RR)
+		if err != nil || rr == nil {
+			logf("error: Failure to parse rr of %q: %q", serv.key, err)
+			continue
+		}
+		if rr.Header().Rrtype != q.Qtype && q.Qtype != dns.TypeANY {
+			continue
+		}
+		rr.Header().Name = q.Name
+		rr.Header().Class = dns.ClassINET
+		rr.Header().Ttl = serv.ttl
+		records = append(records, rr)
+		s.logSource(rr, serv.key)
+	}
+	return records, nil
+}
+
+// nameserverRecords returns the A or AAAA records (depending on qtype) for the
+// nameserver of our domain, using name as the ownername. These are the
+// (resolved) addresses of the etcd machines, or when we don't know those,
+// the addresses from StaticNS.
+func (s *server) nameserverRecords(name string, qtype uint16) (records []dns.RR) {
+	ips := s.machines.addrs()
+	if len(ips) == 0 {
+		for _, a := range s.config.StaticNS {
+			if ip := net.ParseIP(a); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	for _, ip := range ips {
+		switch {
+		case ip.To4() != nil && qtype == dns.TypeA:
+			records = append(records, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.settingsFor(name).ttl}, A: ip.To4()})
+		case ip.To4() == nil && qtype == dns.TypeAAAA:
+			records = append(records, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.settingsFor(name).ttl}, AAAA: ip.To16()})
+		}
+	}
+	return records
+}
+
+// NS returns the NS record of zone for this SkyDNS instance.
+func (s *server) NS(zone string) dns.RR {
+	zone = strings.ToLower(zone)
+	return &dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: s.settingsFor(zone).ttl}, Ns: "master." + zone}
+}
+
+// SOA returns the SOA record of zone for this SkyDNS instance.
+func (s *server) SOA(zone string) dns.RR {
+	zone = strings.ToLower(zone)
+	settings := s.settingsFor(zone)
+	return &dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: settings.ttl},
+		Ns:      "master." + zone,
+		Mbox:    "hostmaster." + zone,
 		Serial:  uint32(time.Now().Truncate(time.Hour).Unix()),
 		Refresh: 28800,
 		Retry:   7200,
 		Expire:  604800,
-		Minttl:  s.MinTtl,
+		Minttl:  settings.minTtl,
+	}
+}
+
+// healthy returns the services that passed their health check.
+func (s *server) healthy(sx []*Service) []*Service {
+	if s.checker == nil {
+		return sx
+	}
+	ok := sx[:0]
+	for _, serv := range sx {
+		if s.checker.healthy(serv) {
+			ok = append(ok, serv)
+		}
+	}
+	return ok
+}
+
+// compress enables name compression for m when it is larger than the
+// Compress threshold from the config, and counts the bytes this saves.
+func (s *server) compress(m *dns.Msg) {
+	if s.config.Compress <= 0 {
+		return
+	}
+	size := m.Len()
+	if size <= s.config.Compress {
+		return
 	}
+	m.Compress = true
+	statsCompressSavedBytes.Add(int64(size - m.Len()))
+}
+
+// truncate sets TC on m when it is a UDP reply that does not fit in the buffer
+// of the client, following the Truncate policy from the config.
+func (s *server) truncate(w dns.ResponseWriter, req, m *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return
+	}
+	size := dns.MinMsgSize
+	opt := req.IsEdns0()
+	if opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	switch s.config.Truncate {
+	case "drop-extra":
+		if m.Len() > size {
+			// Keep the OPT record, it is not data.
+			var extra []dns.RR
+			for _, r := range m.Extra {
+				if r.Header().Rrtype == dns.TypeOPT {
+					extra = append(extra, r)
+				}
+			}
+			m.Extra = extra
+		}
+	case "trim", "pad-to-advertised":
+		// Drop the additional records, then the answers, from the end until
+		// the reply fits. The OPT record and signed answers are kept.
+		extra, answers := len(m.Extra), len(m.Answer)
+		for i := len(m.Extra) - 1; i >= 0 && m.Len() > size; i-- {
+			if m.Extra[i].Header().Rrtype != dns.TypeOPT {
+				m.Extra = append(m.Extra[:i], m.Extra[i+1:]...)
+			}
+		}
+		for !signed(m.Answer) && len(m.Answer) > 1 && m.Len() > size {
+			m.Answer = m.Answer[:len(m.Answer)-1]
+		}
+		// TC tells the client there is more, it can retry over TCP. With trim
+		// that is only when answers were dropped.
+		dropped := len(m.Answer) < answers
+		if s.config.Truncate == "pad-to-advertised" {
+			dropped = dropped || len(m.Extra) < extra
+		}
+		m.Truncated = dropped || m.Len() > size
+		return
+	}
+	m.Truncated = m.Len() > size
+}
+
+// signed returns true when rrs has signatures.
+func signed(rrs []dns.RR) bool {
+	for _, r := range rrs {
+		if r.Header().Rrtype == dns.TypeRRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+// limitExtra returns at most n records from extra, when there are more the
+// records are picked at random, so all SRV targets get a fair chance to
+// have their address included. The order of extra is kept. A zero n means
+// no limit.
+func (s *server) limitExtra(extra []dns.RR, n int) []dns.RR {
+	if n <= 0 || len(extra) <= n {
+		return extra
+	}
+	s.randLock.Lock()
+	pick := s.rand.Perm(len(extra))[:n]
+	s.randLock.Unlock()
+	sort.Ints(pick)
+	limited := make([]dns.RR, n)
+	for i, p := range pick {
+		limited[i] = extra[p]
+	}
+	return limited
+}
+
+// srvWeights returns the SRV weight of each service. Within a priority every
+// distinct Host and Port gets an equal share of 100, services registering the
+// same Host and Port split the share of that target between them, so a
+// duplicate registration does not skew the weights towards it.
+func srvWeights(sx []*Service) map[*Service]uint16 {
+	type target struct {
+		priority int
+		hp       string
+	}
+	copies := make(map[target]int, len(sx))
+	targets := make(map[int]int) // distinct targets per priority
+	for _, serv := range sx {
+		if serv.Host == "" || serv.stale {
+			continue
+		}
+		t := target{serv.Priority, net.JoinHostPort(serv.Host, strconv.Itoa(serv.Port))}
+		if copies[t] == 0 {
+			targets[serv.Priority]++
+		}
+		copies[t]++
+	}
+	weights := make(map[*Service]uint16, len(sx))
+	for _, serv := range sx {
+		if serv.Host == "" || serv.stale {
+			continue
+		}
+		t := target{serv.Priority, net.JoinHostPort(serv.Host, strconv.Itoa(serv.Port))}
+		weights[serv] = uint16(math.Floor(100 / float64(targets[serv.Priority]*copies[t])))
+	}
+	return weights
+}
+
+// logSource logs the etcd key responsible for rr, when verbose logging is on.
+func (s *server) logSource(rr dns.RR, key string) {
+	if s.settings().verbose {
+		log.Printf("Answer %q from %q", rr.String(), key)
+	}
+}
+
+// services returns the services found in r that are visible in view (a TSIG
+// key name), this is either a single service or, when r is a directory, all
+// the services below it. When a single service can not be parsed ErrBadData
+// is returned.
+func (s *server) services(r *etcd.Response, view string) ([]*Service, error) {
+	sx, err := s.servicesBelow(r, false)
+	if err != nil {
+		return nil, err
+	}
+	return visible(s.aliases(withoutDelegations(sx), 0), view), nil
+}
+
+// maxAliasDepth limits how many aliases are followed, so a loop ends.
+const maxAliasDepth = 8
+
+// aliases replaces the services that have AliasOf set by the services of the
+// name they are an alias of.
+func (s *server) aliases(sx []*Service, depth int) []*Service {
+	ax := make([]*Service, 0, len(sx))
+	for _, serv := range sx {
+		if serv.AliasOf == "" {
+			ax = append(ax, serv)
+			continue
+		}
+		if depth >= maxAliasDepth {
+			logf("error: Too many aliases following %q", serv.key)
+			continue
+		}
+		r, err := s.getName(strings.ToLower(dns.Fqdn(serv.AliasOf)))
+		if err != nil {
+			if err != ErrNotFound {
+				logf("error: Failure to get alias %q of %q: %q", serv.AliasOf, serv.key, err)
+			}
+			continue
+		}
+		tx, err := s.servicesBelow(r, false)
+		if err != nil {
+			continue
+		}
+		ax = append(ax, s.aliases(tx, depth+1)...)
+	}
+	return ax
+}
+
+// allServices is like services, but includes the services under names with
+// a leading underscore. This is used for zone transfers.
+func (s *server) allServices(r *etcd.Response) ([]*Service, error) {
+	return s.servicesBelow(r, true)
+}
+
+func (s *server) servicesBelow(r *etcd.Response, underscore bool) ([]*Service, error) {
+	if r.Node.Dir {
+		return s.loopNodes(&r.Node.Nodes, underscore), nil
+	}
+	serv, err := s.newService(r.Node)
+	if err != nil {
+		logf("error: Failure to parse value: %q", err)
+		return nil, ErrBadData
+	}
+	return []*Service{serv}, nil
 }
 
 // loopNodes recursively loops through the nodes and returns all the values.
-func (s *server) loopNodes(n *etcd.Nodes) (sx []*Service) {
+// Names with a leading underscore (_acme-challenge, _dmarc, ...) and the @
+// key of the apex are not part of the name above them, these are skipped
+// unless underscore is true.
+func (s *server) loopNodes(n *etcd.Nodes, underscore bool) (sx []*Service) {
 	for _, n := range *n {
-		serv := new(Service)
-		if n.Dir {
-			sx = append(sx, s.loopNodes(&n.Nodes)...)
+		if !underscore && (strings.HasPrefix(pathpkg.Base(n.Key), "_") || pathpkg.Base(n.Key) == "@") {
 			continue
 		}
-		if err := json.Unmarshal([]byte(n.Value), &serv); err != nil {
-			log.Printf("error: Failure to parse value: %q", err)
+		if n.Dir {
+			sx = append(sx, s.loopNodes(&n.Nodes, underscore)...)
 			continue
 		}
-		serv.ttl = uint32(n.TTL)
-		if serv.ttl == 0 {
-			serv.ttl = s.Ttl
+		serv, err := s.newService(n)
+		if err != nil {
+			logf("error: Failure to parse value: %q", err)
+			continue
 		}
-		serv.key = n.Key
 		sx = append(sx, serv)
 	}
 	return
 }
 
+// newService parses the service stored in n. A negative TTL is used by the
+// zone to signal a service in its grace period.
+func (s *server) newService(n *etcd.Node) (*Service, error) {
+	if max := s.config.MaxValueSize; max > 0 && len(n.Value) > max {
+		statsOversizedCount.Add(1)
+		return nil, fmt.Errorf("value of %q is larger than %d bytes", n.Key, max)
+	}
+	serv := new(Service)
+	if err := json.Unmarshal([]byte(n.Value), &serv); err != nil {
+		return nil, err
+	}
+	st := s.settingsFor(domain(n.Key))
+	if st.priority != nil || st.weight != nil {
+		// Only when the service does not set these.
+		var set struct{ Priority, Weight *int }
+		json.Unmarshal([]byte(n.Value), &set)
+		if set.Priority == nil && st.priority != nil {
+			serv.Priority = *st.priority
+		}
+		if set.Weight == nil && st.weight != nil {
+			serv.Weight = *st.weight
+		}
+	}
+	switch {
+	case n.TTL < 0:
+		serv.stale = true
+		serv.ttl = 1
+	case n.TTL == 0:
+		serv.ttl = st.ttl
+	default:
+		serv.ttl = uint32(n.TTL)
+	}
+	serv.key = n.Key
+	return serv, nil
+}
+
+// flatKeys is set when the names are stored with flat keys, see FlatKeys.
+var flatKeys bool
+
 // path converts a domainname to an etcd path. If s looks like service.staging.skydns.local.,
-// the resulting key will be /skydns/local/skydns/staging/service .
+// the resulting key will be /skydns/local/skydns/staging/service, or
+// /skydns/local.skydns.staging.service with flat keys.
 func path(s string) string {
 	l := dns.SplitDomainName(s)
 	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
 		l[i], l[j] = l[j], l[i]
 	}
+	if flatKeys {
+		return "/skydns/" + strings.Join(l, ".")
+	}
 	// TODO(miek): escape slashes in s.
 	return "/skydns/" + strings.Join(l, "/")
 }
 
-// domain is the opposite of path.
+// getName returns the (recursive) contents of the key of name, see get. With
+// flat keys the names made up for the services below a name are found too,
+// i.e. 4.rails.skydns.local. in /skydns/local.skydns.rails/4.
+func (s *server) getName(name string) (*etcd.Response, error) {
+	r, err := s.get(path(name))
+	if err != ErrNotFound || !flatKeys {
+		return r, err
+	}
+	i, end := dns.NextLabel(name, 0)
+	if end || i == 0 {
+		return r, err
+	}
+	return s.get(path(name[i:]) + "/" + name[:i-1])
+}
+
+// treePath returns the key holding all the names in zone, with flat keys
+// this is the entire tree and names outside zone must be skipped.
+func treePath(zone string) string {
+	if flatKeys {
+		return "/skydns"
+	}
+	return path(zone)
+}
+
+// domain is the opposite of path. With flat keys a key below a name, when it
+// is a directory, is named by prepending its label to that name.
 func domain(s string) string {
+	if flatKeys {
+		k := strings.Split(strings.TrimPrefix(s, "/skydns/"), "/")
+		l := strings.Split(k[0], ".")
+		for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+			l[i], l[j] = l[j], l[i]
+		}
+		for _, c := range k[1:] {
+			l = append([]string{c}, l...)
+		}
+		return dns.Fqdn(strings.Join(l, "."))
+	}
 	l := strings.Split(s, "/")
 	// start with 1, to strip /skydns
 	for i, j := 1, len(l)-1; i < j; i, j = i+1, j-1 {
@@ -0,0 +1,344 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// newTestServer returns a server with config, after setting the defaults. It
+// is not connected to etcd.
+func newTestServer(t *testing.T, config *Config) *server {
+	if err := setDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(config, nil)
+}
+
+// newZoneServer returns a test server that answers from an in-memory zone
+// holding services, which maps keys to values.
+func newZoneServer(t *testing.T, config *Config, services map[string]string) *server {
+	s := newTestServer(t, config)
+	root := &etcd.Node{Key: "/skydns", Dir: true}
+	for key, value := range services {
+		root = replaceNode(root, key, &etcd.Node{Key: key, Value: value})
+	}
+	s.zone = newZone(nil, 0)
+	s.zone.restore(root, 1)
+	return s
+}
+
+// types returns the types of rrs.
+func types(rrs []dns.RR) []uint16 {
+	var t []uint16
+	for _, r := range rrs {
+		t = append(t, r.Header().Rrtype)
+	}
+	return t
+}
+
+func sameTypes(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func addresses(n int) []dns.RR {
+	var rrs []dns.RR
+	for i := 0; i < n; i++ {
+		rrs = append(rrs, &dns.A{Hdr: dns.RR_Header{Name: "a.skydns.local.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A: net.IPv4(10, 0, 0, byte(i))})
+	}
+	return rrs
+}
+
+func sameRRs(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSeedReproducible(t *testing.T) {
+	s1 := newTestServer(t, &Config{Seed: 42})
+	s2 := newTestServer(t, &Config{Seed: 42})
+
+	a1, a2 := addresses(10), addresses(10)
+	s1.shuffle(a1)
+	s2.shuffle(a2)
+	if !sameRRs(a1, a2) {
+		t.Errorf("shuffle with the same seed differs:\n%v\n%v", a1, a2)
+	}
+	for i := 0; i < 5; i++ {
+		e1, e2 := s1.limitExtra(addresses(10), 3), s2.limitExtra(addresses(10), 3)
+		if len(e1) != 3 {
+			t.Fatalf("expected 3 records, got %d", len(e1))
+		}
+		if !sameRRs(e1, e2) {
+			t.Errorf("limitExtra with the same seed differs:\n%v\n%v", e1, e2)
+		}
+	}
+}
+
+var apexServices = map[string]string{
+	"/skydns/local/skydns/web/1":  `{"Host":"10.0.0.1","Port":80}`,
+	"/skydns/local/skydns/@/spf":  `{"Text":"v=spf1 -all"}`,
+	"/skydns/local/skydns/@/mail": `{"RR":"skydns.local. MX 10 mail.skydns.local."}`,
+}
+
+func TestApex(t *testing.T) {
+	tests := []struct {
+		qtype   uint16
+		apexSRV bool
+		answer  []uint16 // nil for NODATA
+	}{
+		{qtype: dns.TypeSOA, answer: []uint16{dns.TypeSOA}},
+		{qtype: dns.TypeNS, answer: []uint16{dns.TypeNS}},
+		{qtype: dns.TypeA, answer: []uint16{dns.TypeA}},
+		{qtype: dns.TypeAAAA},
+		{qtype: dns.TypeDNSKEY}, // not signed
+		{qtype: dns.TypeTXT, answer: []uint16{dns.TypeTXT}},
+		{qtype: dns.TypeMX, answer: []uint16{dns.TypeMX}},
+		{qtype: dns.TypeSRV},
+		{qtype: dns.TypeSRV, apexSRV: true, answer: []uint16{dns.TypeSRV}},
+		{qtype: dns.TypeANY, answer: []uint16{dns.TypeSOA, dns.TypeNS, dns.TypeTXT, dns.TypeMX}},
+		{qtype: dns.TypeCNAME},
+		{qtype: dns.TypeHINFO},
+		{qtype: dns.TypePTR},
+	}
+	for _, tc := range tests {
+		s := newZoneServer(t, &Config{StaticNS: []string{"192.0.2.1"}, ApexSRV: tc.apexSRV}, apexServices)
+		q := dns.Question{Name: "skydns.local.", Qtype: tc.qtype, Qclass: dns.ClassINET}
+		m := new(dns.Msg)
+		if err := s.apex(m, q, nil, ""); err != nil {
+			t.Errorf("%s (apex_srv %t): %s", dns.TypeToString[tc.qtype], tc.apexSRV, err)
+			continue
+		}
+		if got := types(m.Answer); !sameTypes(got, tc.answer) {
+			t.Errorf("%s (apex_srv %t): expected answer types %v, got %v", dns.TypeToString[tc.qtype], tc.apexSRV, tc.answer, got)
+		}
+		nodata := len(m.Ns) == 1 && m.Ns[0].Header().Rrtype == dns.TypeSOA
+		if nodata != (tc.answer == nil) {
+			t.Errorf("%s (apex_srv %t): expected NODATA %t, got %t", dns.TypeToString[tc.qtype], tc.apexSRV, tc.answer == nil, nodata)
+		}
+	}
+}
+
+func TestQuestionCount(t *testing.T) {
+	q := dns.Question{Name: "web.skydns.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	tests := []struct {
+		questions     []dns.Question
+		multiQuestion bool
+		rcode         int
+	}{
+		{questions: nil, rcode: dns.RcodeFormatError},
+		{questions: nil, multiQuestion: true, rcode: dns.RcodeFormatError},
+		{questions: []dns.Question{q}, rcode: dns.RcodeNameError},
+		{questions: []dns.Question{q, q}, rcode: dns.RcodeFormatError},
+		{questions: []dns.Question{q, q}, multiQuestion: true, rcode: dns.RcodeNameError},
+	}
+	for _, tc := range tests {
+		s := newZoneServer(t, &Config{Nameservers: []string{"127.0.0.1:53"}, MultiQuestion: tc.multiQuestion}, nil)
+		req := new(dns.Msg)
+		req.Id = dns.Id()
+		req.Question = tc.questions
+		w := &dohWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+		s.ServeDNS(w, req)
+		if w.msg == nil {
+			t.Errorf("%d questions (multi_question %t): no reply", len(tc.questions), tc.multiQuestion)
+			continue
+		}
+		if w.msg.Rcode != tc.rcode {
+			t.Errorf("%d questions (multi_question %t): expected rcode %s, got %s", len(tc.questions), tc.multiQuestion,
+				dns.RcodeToString[tc.rcode], dns.RcodeToString[w.msg.Rcode])
+		}
+	}
+}
+
+func TestSRVWeights(t *testing.T) {
+	a := Service{Host: "10.0.0.1", Port: 80}
+	b := Service{Host: "10.0.0.2", Port: 80}
+	c := Service{Host: "10.0.0.3", Port: 80}
+	tests := []struct {
+		sx      []Service
+		weights []int // -1 when the service has no weight
+	}{
+		{[]Service{a, b}, []int{50, 50}},
+		{[]Service{a, a, b}, []int{25, 25, 50}},
+		{[]Service{a, a, a, b, c}, []int{11, 11, 11, 33, 33}},
+		{[]Service{a, a, b, b, c}, []int{16, 16, 16, 16, 33}},
+		{[]Service{a, {Host: "10.0.0.1", Port: 8080}}, []int{50, 50}},
+		{[]Service{a, a, {Host: "10.0.0.2", Port: 80, Priority: 20}}, []int{50, 50, 100}},
+		{[]Service{a, {Host: "10.0.0.1", Port: 80, Priority: 20}, b}, []int{50, 100, 50}},
+		{[]Service{a, a, {Text: "no host"}}, []int{50, 50, -1}},
+		{[]Service{a, {Host: "10.0.0.1", Port: 80, stale: true}, b}, []int{50, -1, 50}},
+	}
+	for i, tc := range tests {
+		sx := make([]*Service, len(tc.sx))
+		for j := range tc.sx {
+			serv := tc.sx[j]
+			sx[j] = &serv
+		}
+		weights := srvWeights(sx)
+		for j, serv := range sx {
+			w, ok := weights[serv]
+			if tc.weights[j] == -1 {
+				if ok {
+					t.Errorf("test %d, service %d: expected no weight, got %d", i, j, w)
+				}
+				continue
+			}
+			if !ok || int(w) != tc.weights[j] {
+				t.Errorf("test %d, service %d: expected weight %d, got %d", i, j, tc.weights[j], w)
+			}
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	udp := &dohWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+	for _, policy := range []string{"truncate", "drop-extra", "trim", "pad-to-advertised"} {
+		for _, bufsize := range []uint16{0, 4096} {
+			s := newTestServer(t, &Config{Nameservers: []string{"127.0.0.1:53"}, Truncate: policy})
+			req := new(dns.Msg)
+			req.SetQuestion("a.skydns.local.", dns.TypeA)
+			if bufsize > 0 {
+				req.SetEdns0(bufsize, false)
+			}
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = addresses(60)
+			s.truncate(udp, req, m)
+			fits := m.Len() <= 512
+			if bufsize == 0 && !fits && !m.Truncated {
+				t.Errorf("%s: reply of %d bytes to a client without EDNS0 not truncated", policy, m.Len())
+			}
+			if bufsize == 4096 && m.Truncated {
+				t.Errorf("%s: reply of %d bytes truncated for a buffer of %d", policy, m.Len(), bufsize)
+			}
+		}
+	}
+}
+
+func TestDomainPath(t *testing.T) {
+	defer func() { flatKeys = false }()
+	tests := []struct {
+		flat bool
+		key  string
+		name string
+	}{
+		{false, "/skydns/local/skydns/rails/4", "4.rails.skydns.local."},
+		{false, "/skydns/local/skydns", "skydns.local."},
+		{true, "/skydns/local.skydns.rails", "rails.skydns.local."},
+		{true, "/skydns/local.skydns.rails/4", "4.rails.skydns.local."},
+		{true, "/skydns/local.skydns", "skydns.local."},
+	}
+	for _, tc := range tests {
+		flatKeys = tc.flat
+		if name := domain(tc.key); name != tc.name {
+			t.Errorf("flat keys %t: expected domain of %q to be %q, got %q", tc.flat, tc.key, tc.name, name)
+		}
+		// Names below a flat key have no key of their own, see getName.
+		if tc.flat && strings.Contains(strings.TrimPrefix(tc.key, "/skydns/"), "/") {
+			continue
+		}
+		if key := path(tc.name); key != tc.key {
+			t.Errorf("flat keys %t: expected path of %q to be %q, got %q", tc.flat, tc.name, tc.key, key)
+		}
+	}
+}
+
+func TestFlatKeysNames(t *testing.T) {
+	defer func() { flatKeys = false }()
+	s := newZoneServer(t, &Config{FlatKeys: true}, map[string]string{
+		"/skydns/local.skydns.rails/4": `{"Host":"10.0.0.4","Port":8080}`,
+		"/skydns/local.skydns.rails/5": `{"Host":"10.0.0.5","Port":8081}`,
+	})
+
+	tests := []struct {
+		name string
+		key  string // empty when name doesn't exist
+	}{
+		{"rails.skydns.local.", "/skydns/local.skydns.rails"},
+		{"4.rails.skydns.local.", "/skydns/local.skydns.rails/4"},
+		{"6.rails.skydns.local.", ""},
+		{"4.6.rails.skydns.local.", ""},
+	}
+	for _, tc := range tests {
+		r, err := s.getName(tc.name)
+		if tc.key == "" {
+			if err != ErrNotFound {
+				t.Errorf("%s: expected ErrNotFound, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if r.Node.Key != tc.key {
+			t.Errorf("%s: expected key %q, got %q", tc.name, tc.key, r.Node.Key)
+		}
+	}
+
+	q := dns.Question{Name: "4.rails.skydns.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+	records, _, err := s.SRVRecords(q, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 SRV record, got %v", records)
+	}
+	if srv := records[0].(*dns.SRV); srv.Port != 8080 || srv.Target != "4.rails.skydns.local." {
+		t.Errorf("expected SRV record for port 8080 at 4.rails.skydns.local., got %s", srv)
+	}
+	q.Qtype = dns.TypeA
+	records, err = s.AddressRecords(q, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.4")) {
+		t.Errorf("expected A record for 10.0.0.4, got %v", records)
+	}
+}
+
+func TestStaticRecordsDomains(t *testing.T) {
+	config := &Config{Domains: []string{"example.org."}}
+	if err := setDefaults(config); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rr string
+		ok bool
+	}{
+		{"skydns.local. 3600 IN MX 10 mail.example.com.", true},
+		{"www.skydns.local. 3600 IN TXT \"x\"", true},
+		{"example.org. 3600 IN MX 10 mail.example.org.", true},
+		{"evilskydns.local. 3600 IN TXT \"x\"", false},
+		{"example.com. 3600 IN TXT \"x\"", false},
+	}
+	for _, tc := range tests {
+		_, err := parseStaticRecords([]string{tc.rr}, config)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: expected accepted %t, got error %v", tc.rr, tc.ok, err)
+		}
+	}
+}
@@ -4,16 +4,133 @@
 
 package main
 
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
 type Service struct {
 	// This *is* the rdata from a SRV record, but with a twist.
 	// Host (Target in SRV) must be a domain name, but if it looks like an IP
 	// address (4/6), we will treat it like an IP address.
 
 	Priority int
-	//	Weight   int // Don't let the API set weights, we will do this automatically.
-	Port int
-	Host string
+	// Weight is not used for SRV records, we do these automatically, but
+	// orders the addresses when AddressWeights is set.
+	Weight int `json:",omitempty"`
+	Port   int
+	Host   string
+	// Ports are named ports, i.e. {"http/tcp":8080}, these are returned for
+	// SRV queries for _http._tcp.<name>.
+	Ports map[string]int `json:",omitempty"`
+	// Text is returned in a TXT record, TXT are more strings for that
+	// record. These are in zone file format, a backslash starts an escape,
+	// and are split in strings of at most 255 bytes. With TextEncoding
+	// "base64" they hold base64 encoded binary data instead.
+	Text         string   `json:",omitempty"`
+	TXT          []string `json:",omitempty"`
+	TextEncoding string   `json:",omitempty"`
+	// Check is an optional health check, unhealthy services are not returned.
+	Check *Check `json:",omitempty"`
+	// StaleTTL is the number of seconds this service is still returned, at the
+	// lowest priority, after its key expired. This overrides Grace and only
+	// works when Preload is set.
+	StaleTTL int `json:",omitempty"`
+	// RR is a complete resource record in text format, i.e. "x IN HINFO cpu os",
+	// for record types that have no field of their own. The ownername, class
+	// and TTL are replaced by ours.
+	RR string `json:",omitempty"`
+	// NS marks this service as a nameserver for the name above it, which is
+	// then delegated to the nameservers below it. Host is the nameserver.
+	NS bool `json:",omitempty"`
+	// AliasOf is the name of another service, this service then has the
+	// records of that name instead of its own.
+	AliasOf string `json:",omitempty"`
+	// Views lists the TSIG key names of the clients that get this service,
+	// when empty everyone does.
+	Views []string `json:",omitempty"`
+
+	ttl   uint32
+	key   string
+	stale bool // expired, but still in the grace period
+}
+
+// visibleTo returns true when a client with TSIG key may get the service.
+func (s *Service) visibleTo(key string) bool {
+	if len(s.Views) == 0 {
+		return true
+	}
+	for _, v := range s.Views {
+		if key != "" && dns.Fqdn(strings.ToLower(v)) == key {
+			return true
+		}
+	}
+	return false
+}
 
-	ttl uint32
-	key string
+// txt returns the strings of the TXT record of the service, nil when it has
+// none.
+func (s *Service) txt() ([]string, error) {
+	var txt []string
+	for _, t := range append([]string{s.Text}, s.TXT...) {
+		if t == "" {
+			continue
+		}
+		if s.TextEncoding == "base64" {
+			b, err := base64.StdEncoding.DecodeString(t)
+			if err != nil {
+				return nil, err
+			}
+			t = txtEscape(b)
+		}
+		txt = append(txt, txtSplit(t)...)
+	}
+	return txt, nil
 }
+
+// txtEscape returns b in zone file format, bytes that are not printable are
+// escaped as \DDD.
+func txtEscape(b []byte) string {
+	var buf bytes.Buffer
+	for _, c := range b {
+		switch {
+		case c == '\\' || c == '"':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&buf, "\\%03d", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// txtSplit splits t, in zone file format, in strings of at most 255 bytes
+// on the wire. Escapes are not split.
+func txtSplit(t string) []string {
+	var l []string
+	start, n := 0, 0
+	for i := 0; i < len(t); {
+		w := 1 // length of the escape in t, it is a single byte on the wire
+		if t[i] == '\\' && i+1 < len(t) {
+			w = 2
+			if i+3 < len(t) && isDigit(t[i+1]) && isDigit(t[i+2]) && isDigit(t[i+3]) {
+				w = 4
+			}
+		}
+		if n == 255 {
+			l = append(l, t[start:i])
+			start, n = i, 0
+		}
+		i += w
+		n++
+	}
+	return append(l, t[start:])
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
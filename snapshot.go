@@ -0,0 +1,125 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+var (
+	snapshotLock sync.Mutex
+	snapshotTime time.Time // time of the last snapshot written or read
+)
+
+func init() {
+	expvar.Publish("skydns_snapshot_age", expvar.Func(func() interface{} {
+		snapshotLock.Lock()
+		defer snapshotLock.Unlock()
+		if snapshotTime.IsZero() {
+			return -1
+		}
+		return int64(time.Since(snapshotTime) / time.Second)
+	}))
+}
+
+// snapshot periodically writes the /skydns tree to file, so we can start
+// without etcd. It blocks, so should be run in a goroutine. It returns when
+// the server stops.
+func (s *server) snapshot(file string, interval time.Duration) {
+	for {
+		if err := writeSnapshot(s.client, file); err != nil {
+			log.Printf("error: Failure to write snapshot: %q", err)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// writeSnapshot writes the /skydns tree as gzipped JSON to file. It writes
+// to a temporary file first, so a failure does not clobber the last snapshot.
+func writeSnapshot(client *etcd.Client, file string) error {
+	r, err := client.Get("/skydns", false, true)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	z := gzip.NewWriter(f)
+	err = json.NewEncoder(z).Encode(r.Node)
+	if err1 := z.Close(); err == nil {
+		err = err1
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+	snapshotLock.Lock()
+	snapshotTime = time.Now()
+	snapshotLock.Unlock()
+	return nil
+}
+
+// readSnapshot reads the /skydns tree from file.
+func readSnapshot(file string) (*etcd.Node, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	n := new(etcd.Node)
+	if err := json.NewDecoder(z).Decode(n); err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil {
+		snapshotLock.Lock()
+		snapshotTime = fi.ModTime()
+		snapshotLock.Unlock()
+	}
+	return n, nil
+}
+
+// snapshotConfig returns the config stored in the snapshot n.
+func snapshotConfig(n *etcd.Node) (*Config, error) {
+	for _, c := range n.Nodes {
+		if c.Key != "/skydns/config" {
+			continue
+		}
+		config := new(Config)
+		if err := json.Unmarshal([]byte(c.Value), config); err != nil {
+			return nil, err
+		}
+		if err := setDefaults(config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+	return nil, fmt.Errorf("no config in snapshot")
+}
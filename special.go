@@ -0,0 +1,114 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// specialZones are the special-use domains (RFC 6761) and the reverse zones
+// of the private and local address ranges (RFC 6303) that we answer
+// ourselves, instead of leaking these queries upstream.
+var specialZones = func() map[string]bool {
+	z := map[string]bool{
+		"localhost.":                    true,
+		"invalid.":                      true,
+		"test.":                         true,
+		"10.in-addr.arpa.":              true,
+		"127.in-addr.arpa.":             true,
+		"254.169.in-addr.arpa.":         true,
+		"168.192.in-addr.arpa.":         true,
+		"0.in-addr.arpa.":               true,
+		"255.255.255.255.in-addr.arpa.": true,
+		"d.f.ip6.arpa.":                 true, // fd00::/8, unique local
+		"8.e.f.ip6.arpa.":               true, // fe80::/10, link local
+		"9.e.f.ip6.arpa.":               true,
+		"a.e.f.ip6.arpa.":               true,
+		"b.e.f.ip6.arpa.":               true,
+		"1." + strings.Repeat("0.", 31) + "ip6.arpa.": true, // ::1
+		strings.Repeat("0.", 32) + "ip6.arpa.":        true, // ::
+	}
+	for i := 16; i < 32; i++ {
+		z[strconv.Itoa(i)+".172.in-addr.arpa."] = true
+	}
+	return z
+}()
+
+// specialZone returns the special-use zone name is in, or "".
+func specialZone(name string) string {
+	name = strings.ToLower(name)
+	for {
+		if specialZones[name] {
+			return name
+		}
+		i, end := dns.NextLabel(name, 0)
+		if end {
+			return ""
+		}
+		name = name[i:]
+	}
+}
+
+// ServeDNSSpecialUse answers queries for the special-use domains and private
+// reverse zones. It returns false when the name isn't in one of these, or
+// ForwardSpecialUse is set. Names in localhost. resolve to the loopback
+// addresses, the reverse of these to localhost.; the zones themselves exist,
+// with only a SOA record; all other names don't exist.
+func (s *server) ServeDNSSpecialUse(w dns.ResponseWriter, req *dns.Msg) bool {
+	if s.config.ForwardSpecialUse {
+		return false
+	}
+	q := req.Question[0]
+	zone := specialZone(q.Name)
+	if zone == "" {
+		return false
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.CheckingDisabled = req.CheckingDisabled
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: s.settings().ttl}
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.settings().minTtl},
+		Ns: zone, Mbox: "nobody.invalid.", Serial: 1, Refresh: 28800, Retry: 7200, Expire: 604800, Minttl: s.settings().minTtl}
+	exists := false
+	switch {
+	case zone == "localhost.":
+		exists = true
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1).To4()})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+		}
+	case zone == "127.in-addr.arpa." || zone == "1."+strings.Repeat("0.", 31)+"ip6.arpa.":
+		if ip := reverseIP(q.Name); ip != nil && ip.IsLoopback() {
+			exists = true
+			if q.Qtype == dns.TypePTR {
+				m.Answer = append(m.Answer, &dns.PTR{Hdr: hdr, Ptr: "localhost."})
+			}
+		}
+	}
+	if strings.ToLower(q.Name) == zone {
+		// The apex, i.e. 10.in-addr.arpa., gets NODATA, not NXDOMAIN.
+		exists = true
+		if q.Qtype == dns.TypeSOA {
+			m.Answer = append(m.Answer, soa)
+		}
+	}
+	if !exists {
+		m.SetRcode(req, dns.RcodeNameError)
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{soa}
+	}
+	s.origin(m, req, originLocal)
+	w.WriteMsg(m)
+	return true
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSpecialUse(t *testing.T) {
+	s := newTestServer(t, &Config{Nameservers: []string{"127.0.0.1:53"}})
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []uint16
+	}{
+		{"localhost.", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeA}},
+		{"web.localhost.", dns.TypeAAAA, dns.RcodeSuccess, []uint16{dns.TypeAAAA}},
+		{"localhost.", dns.TypeMX, dns.RcodeSuccess, nil},
+		{"localhost.", dns.TypeSOA, dns.RcodeSuccess, []uint16{dns.TypeSOA}},
+		{"1.0.0.127.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []uint16{dns.TypePTR}},
+		{"10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, nil},
+		{"10.in-addr.arpa.", dns.TypeSOA, dns.RcodeSuccess, []uint16{dns.TypeSOA}},
+		{"17.172.in-addr.arpa.", dns.TypeNS, dns.RcodeSuccess, nil},
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, nil},
+		{"invalid.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"foo.invalid.", dns.TypeA, dns.RcodeNameError, nil},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		w := &dohWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+		if !s.ServeDNSSpecialUse(w, req) {
+			t.Errorf("%s: not answered", tc.name)
+			continue
+		}
+		if w.msg.Rcode != tc.rcode {
+			t.Errorf("%s %s: expected rcode %s, got %s", tc.name, dns.TypeToString[tc.qtype], dns.RcodeToString[tc.rcode], dns.RcodeToString[w.msg.Rcode])
+		}
+		if got := types(w.msg.Answer); !sameTypes(got, tc.answer) {
+			t.Errorf("%s %s: expected answer types %v, got %v", tc.name, dns.TypeToString[tc.qtype], tc.answer, got)
+		}
+		if len(w.msg.Answer) == 0 && (len(w.msg.Ns) != 1 || w.msg.Ns[0].Header().Rrtype != dns.TypeSOA) {
+			t.Errorf("%s %s: expected SOA in the authority section, got %v", tc.name, dns.TypeToString[tc.qtype], w.msg.Ns)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// staleCache keeps the last good response from etcd for each key, so we
+// can keep answering (RFC 8767) when etcd is unavailable. Responses older
+// than maxStale are not used and are eventually removed.
+type staleCache struct {
+	sync.Mutex
+	maxStale time.Duration
+	m        map[string]*staleEntry
+}
+
+type staleEntry struct {
+	r    *etcd.Response
+	seen time.Time
+}
+
+func newStaleCache(maxStale time.Duration) *staleCache {
+	return &staleCache{maxStale: maxStale, m: make(map[string]*staleEntry)}
+}
+
+// set stores r as the last good response for key.
+func (c *staleCache) set(key string, r *etcd.Response) {
+	c.Lock()
+	c.m[key] = &staleEntry{r: r, seen: time.Now()}
+	c.Unlock()
+}
+
+// get returns the last good response for key, with all nodes marked as
+// stale, or nil when there is none or it is older than maxStale.
+func (c *staleCache) get(key string) *etcd.Response {
+	c.Lock()
+	e, ok := c.m[key]
+	c.Unlock()
+	if !ok || time.Since(e.seen) > c.maxStale {
+		return nil
+	}
+	r := *e.r
+	r.Node = staleNode(e.r.Node)
+	return &r
+}
+
+// sweep periodically removes the responses older than maxStale. It blocks,
+// so should be run in a goroutine. It returns when stop is closed.
+func (c *staleCache) sweep(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.maxStale):
+		}
+		c.Lock()
+		for k, e := range c.m {
+			if time.Since(e.seen) > c.maxStale {
+				delete(c.m, k)
+			}
+		}
+		c.Unlock()
+	}
+}
+
+// staleNode returns a copy of n (and its children) with a negative TTL, the
+// same as expired keys in the grace period, see newService.
+func staleNode(n *etcd.Node) *etcd.Node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	c.TTL = -1
+	c.Nodes = nil
+	for _, child := range n.Nodes {
+		c.Nodes = append(c.Nodes, staleNode(child))
+	}
+	return &c
+}
+
+// forwardCache keeps the last good forwarded reply for each question, so we
+// can keep answering when none of the nameservers respond. Replies older
+// than maxStale are not used and are eventually removed.
+type forwardCache struct {
+	sync.Mutex
+	maxStale time.Duration
+	m        map[string]*forwardEntry
+}
+
+type forwardEntry struct {
+	m    *dns.Msg
+	seen time.Time
+}
+
+func newForwardCache(maxStale time.Duration) *forwardCache {
+	return &forwardCache{maxStale: maxStale, m: make(map[string]*forwardEntry)}
+}
+
+// forwardKey returns the key for req in the forwardCache. The DO bit is part
+// of the key, because it changes the reply.
+func forwardKey(req *dns.Msg) string {
+	q := req.Question[0]
+	do := "0"
+	if o := req.IsEdns0(); o != nil && o.Do() {
+		do = "1"
+	}
+	return strings.ToLower(q.Name) + "/" + dns.Type(q.Qtype).String() + "/" + dns.Class(q.Qclass).String() + "/" + do
+}
+
+// set stores r as the last good reply to req. Only NOERROR and NXDOMAIN
+// replies are stored.
+func (c *forwardCache) set(req, r *dns.Msg) {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return
+	}
+	c.Lock()
+	c.m[forwardKey(req)] = &forwardEntry{m: r.Copy(), seen: time.Now()}
+	c.Unlock()
+}
+
+// get returns the last good reply to req, with all TTLs set to 0, or nil
+// when there is none or it is older than maxStale.
+func (c *forwardCache) get(req *dns.Msg) *dns.Msg {
+	c.Lock()
+	e, ok := c.m[forwardKey(req)]
+	c.Unlock()
+	if !ok || time.Since(e.seen) > c.maxStale {
+		return nil
+	}
+	m := e.m.Copy()
+	m.Id = req.Id
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// sweep periodically removes the replies older than maxStale. It blocks,
+// so should be run in a goroutine. It returns when stop is closed.
+func (c *forwardCache) sweep(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.maxStale):
+		}
+		c.Lock()
+		for k, e := range c.m {
+			if time.Since(e.seen) > c.maxStale {
+				delete(c.m, k)
+			}
+		}
+		c.Unlock()
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Counters, these are exported via expvar on /debug/vars when the HTTP
+// server is enabled.
+var (
+	statsRequestCount   = expvar.NewInt("skydns_request_count")
+	statsMalformedCount = expvar.NewInt("skydns_malformed_count")
+	statsRefusedCount   = expvar.NewInt("skydns_refused_count")
+
+	// Replies per rcode and per zone: our domain, or else the top level
+	// domain of the query.
+	statsRcode = expvar.NewMap("skydns_rcode")
+	statsZone  = expvar.NewMap("skydns_zone")
+
+	statsListenFailureCount = expvar.NewInt("skydns_listen_failure_count")
+	statsStaleCount         = expvar.NewInt("skydns_stale_count")
+	statsServeStaleCount    = expvar.NewInt("skydns_serve_stale_count")
+	statsForwardStaleCount  = expvar.NewInt("skydns_forward_stale_count")
+	statsQueryTimeoutCount  = expvar.NewInt("skydns_query_timeout_count")
+
+	statsPostProcessFailureCount = expvar.NewInt("skydns_post_process_failure_count")
+	statsMirrorDropCount         = expvar.NewInt("skydns_mirror_drop_count")
+	statsOversizedCount          = expvar.NewInt("skydns_oversized_count")
+	statsCompressSavedBytes      = expvar.NewInt("skydns_compress_saved_bytes")
+
+	// Number of etcd gets that were answered with the result of a concurrent
+	// get for the same key, in total and per key.
+	statsInflightSharedCount = expvar.NewInt("skydns_inflight_shared_count")
+	statsInflightShared      = expvar.NewMap("skydns_inflight_shared")
+
+	// Hash of the config we started with, see setConfigHash.
+	statsConfigHash = expvar.NewString("skydns_config_hash")
+)
+
+// The version and commit of this build, set with i.e.
+// go build -ldflags "-X main.version=2.1.0 -X main.commit=$(git rev-parse --short HEAD)".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+func init() {
+	expvar.Publish("skydns_build_info", expvar.Func(func() interface{} {
+		return map[string]string{"version": version, "commit": commit}
+	}))
+}
+
+// setConfigHash exports a hash of the effective config, after the defaults
+// and the flags are applied, so instances running with a different config
+// stand out. Changes picked up by watchConfig are not included.
+func setConfigHash(config *Config) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		log.Printf("error: Failure to hash config: %q", err)
+		return
+	}
+	h := sha256.Sum256(b)
+	statsConfigHash.Set(hex.EncodeToString(h[:8]))
+}
+
+// malformed keeps track of the number of malformed packets received per
+// source, within a window of a minute. When a source exceeds the threshold
+// this is logged.
+type malformed struct {
+	sync.Mutex
+	threshold int
+	start     time.Time
+	sources   map[string]int
+}
+
+func newMalformed(threshold int) *malformed {
+	return &malformed{threshold: threshold, start: time.Now(), sources: make(map[string]int)}
+}
+
+// add records a malformed packet from source.
+func (m *malformed) add(source string) {
+	statsMalformedCount.Add(1)
+	if m.threshold <= 0 {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	if time.Since(m.start) > time.Minute {
+		m.start = time.Now()
+		m.sources = make(map[string]int)
+	}
+	m.sources[source]++
+	if m.sources[source] == m.threshold {
+		log.Printf("error: Received %d malformed packets from %q in the last minute", m.threshold, source)
+	}
+}
+
+// replyWriter is a dns.ResponseWriter that calls done with the first reply
+// and the time it took since the writer was created.
+type replyWriter struct {
+	dns.ResponseWriter
+	start   time.Time
+	done    func(m *dns.Msg, d time.Duration)
+	written bool
+}
+
+func newReplyWriter(w dns.ResponseWriter, done func(m *dns.Msg, d time.Duration)) *replyWriter {
+	return &replyWriter{ResponseWriter: w, start: time.Now(), done: done}
+}
+
+func (r *replyWriter) WriteMsg(m *dns.Msg) error {
+	if !r.written {
+		r.written = true
+		r.done(m, time.Since(r.start))
+	}
+	return r.ResponseWriter.WriteMsg(m)
+}
+
+// timed returns a replyWriter that records the latency of the reply to req
+// in h, labeled with the qtype and rcode.
+func timed(w dns.ResponseWriter, req *dns.Msg, h *histogramVec) *replyWriter {
+	var qtype uint16
+	if len(req.Question) > 0 {
+		qtype = req.Question[0].Qtype
+	}
+	return newReplyWriter(w, func(m *dns.Msg, d time.Duration) {
+		h.observe(typeString(qtype)+"/"+dns.RcodeToString[m.Rcode], d)
+	})
+}
+
+// counted returns a replyWriter that records the latency of the reply to
+// req like timed, counts the reply per rcode and per zone and writes it to
+// the query log.
+func (s *server) counted(w dns.ResponseWriter, req *dns.Msg) *replyWriter {
+	var qtype uint16
+	zone := "."
+	if len(req.Question) > 0 {
+		qtype = req.Question[0].Qtype
+		zone = s.statsZone(req.Question[0].Name)
+	}
+	return newReplyWriter(w, func(m *dns.Msg, d time.Duration) {
+		rcode := dns.RcodeToString[m.Rcode]
+		statsQueryDuration.observe(typeString(qtype)+"/"+rcode, d)
+		statsRcode.Add(rcode, 1)
+		statsZone.Add(zones.label(zone), 1)
+		if s.querylog != nil && len(req.Question) > 0 {
+			client := ""
+			if ip := remoteIP(w); ip != nil {
+				client = ip.String()
+			}
+			s.querylog.log(&queryRecord{Time: time.Now().UTC(), Name: req.Question[0].Name, Type: typeString(qtype),
+				Client: client, Rcode: rcode, Latency: d.Seconds(), Cached: s.zone != nil && m.Authoritative})
+		}
+	})
+}
+
+// queryTimer records the time spent in each phase of answering a query, so
+// slow queries can be attributed from the verbose log. A nil queryTimer
+// records nothing.
+type queryTimer struct {
+	start  time.Time
+	last   time.Time
+	phases []string
+}
+
+// newQueryTimer returns a queryTimer when verbose logging is on, nil otherwise.
+func (s *server) newQueryTimer() *queryTimer {
+	if !s.settings().verbose {
+		return nil
+	}
+	now := time.Now()
+	return &queryTimer{start: now, last: now}
+}
+
+// mark ends the current phase, naming it phase.
+func (t *queryTimer) mark(phase string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.phases = append(t.phases, phase+"="+now.Sub(t.last).String())
+	t.last = now
+}
+
+// log logs the total time and the time of each phase for q.
+func (t *queryTimer) log(q dns.Question) {
+	if t == nil {
+		return
+	}
+	log.Printf("Query %q %s took %s: %s", q.Name, typeString(q.Qtype), t.last.Sub(t.start), strings.Join(t.phases, " "))
+}
+
+// maxStatsZones is the maximum number of distinct zones counted, the rest is
+// counted as "other", so junk queries can not grow the map without bound.
+const maxStatsZones = 1000
+
+var zones = &zoneSet{m: make(map[string]bool)}
+
+type zoneSet struct {
+	sync.Mutex
+	m map[string]bool
+}
+
+// label returns zone, or "other" when there are already too many zones.
+func (z *zoneSet) label(zone string) string {
+	z.Lock()
+	defer z.Unlock()
+	if z.m[zone] {
+		return zone
+	}
+	if len(z.m) >= maxStatsZones {
+		return "other"
+	}
+	z.m[zone] = true
+	return zone
+}
+
+// statsZone returns the zone name is counted under: our domain when name is
+// in one, otherwise the top level domain of name.
+func (s *server) statsZone(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	if zone := s.zoneOf(name); zone != "" {
+		return zone
+	}
+	l := dns.SplitDomainName(name)
+	if len(l) == 0 {
+		return "."
+	}
+	return l[len(l)-1] + "."
+}
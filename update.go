@@ -0,0 +1,184 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ServeDNSUpdate handles dynamic updates (RFC 2136) for our domains. Each
+// added A, AAAA, SRV or TXT record is stored in its own key below the name,
+// the last label of the key is a hash of the rdata, so we can find it again
+// when the record is deleted.
+func (s *server) ServeDNSUpdate(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	defer func() {
+		if t := req.IsTsig(); t != nil && w.TsigStatus() == nil {
+			m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+		}
+		w.WriteMsg(m)
+	}()
+
+	if !s.config.Update {
+		m.SetRcode(req, dns.RcodeRefused)
+		return
+	}
+	if len(s.config.TsigSecret) > 0 {
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			m.SetRcode(req, dns.RcodeNotAuth)
+			return
+		}
+	}
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		m.SetRcode(req, dns.RcodeNotAuth)
+		return
+	}
+	zone := strings.ToLower(req.Question[0].Name)
+	if s.zoneOf(zone) != zone {
+		m.SetRcode(req, dns.RcodeNotAuth)
+		return
+	}
+	if len(req.Answer) > 0 { // prerequisites
+		m.SetRcode(req, dns.RcodeNotImplemented)
+		return
+	}
+	// Check the entire update section before we touch etcd.
+	for _, r := range req.Ns {
+		name := strings.ToLower(r.Header().Name)
+		if s.zoneOf(name) != zone {
+			m.SetRcode(req, dns.RcodeNotZone)
+			return
+		}
+		if name == zone {
+			// The records of the apex are not ours to change.
+			m.SetRcode(req, dns.RcodeRefused)
+			return
+		}
+		switch r.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeTXT:
+		case dns.TypeANY:
+			if r.Header().Class != dns.ClassANY {
+				m.SetRcode(req, dns.RcodeFormatError)
+				return
+			}
+		default:
+			m.SetRcode(req, dns.RcodeRefused)
+			return
+		}
+	}
+	for _, r := range req.Ns {
+		if err := s.update(r); err != nil {
+			logf("error: Failure to update %q: %q", r.Header().Name, err)
+			m.SetRcode(req, dns.RcodeServerFailure)
+			return
+		}
+	}
+}
+
+// update applies a single RR from the update section to etcd.
+func (s *server) update(r dns.RR) error {
+	h := r.Header()
+	key := path(strings.ToLower(h.Name))
+	switch h.Class {
+	case dns.ClassINET: // add
+		serv := updateService(r)
+		if serv == nil {
+			return fmt.Errorf("unsupported type %d", h.Rrtype)
+		}
+		value, err := json.Marshal(serv)
+		if err != nil {
+			return err
+		}
+		if max := s.config.MaxValueSize; max > 0 && len(value) > max {
+			return fmt.Errorf("service larger than %d bytes", max)
+		}
+		_, err = s.client.Set(key+"/"+rdataHash(r), string(value), 0)
+		return err
+	case dns.ClassNONE: // delete a single RR
+		_, err := s.client.Delete(key+"/"+rdataHash(r), false)
+		if backendError(err) == ErrNotFound {
+			return nil
+		}
+		return err
+	case dns.ClassANY: // delete an RRset or all RRsets
+		if h.Rrtype == dns.TypeANY {
+			_, err := s.client.Delete(key, true)
+			if backendError(err) == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		resp, err := s.client.Get(key, false, false)
+		if backendError(err) == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, n := range resp.Node.Nodes {
+			if n.Dir {
+				continue
+			}
+			var serv *Service
+			if err := json.Unmarshal([]byte(n.Value), &serv); err != nil {
+				continue
+			}
+			if !updateMatch(serv, h.Rrtype) {
+				continue
+			}
+			if _, err := s.client.Delete(n.Key, false); err != nil && backendError(err) != ErrNotFound {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateService converts an RR to the Service we store in etcd.
+func updateService(r dns.RR) *Service {
+	switch t := r.(type) {
+	case *dns.A:
+		return &Service{Host: t.A.String()}
+	case *dns.AAAA:
+		return &Service{Host: t.AAAA.String()}
+	case *dns.SRV:
+		return &Service{Host: strings.TrimSuffix(t.Target, "."), Port: int(t.Port), Priority: int(t.Priority)}
+	case *dns.TXT:
+		return &Service{TXT: t.Txt}
+	}
+	return nil
+}
+
+// updateMatch returns true when serv provides a record of type qtype.
+func updateMatch(serv *Service, qtype uint16) bool {
+	ip := net.ParseIP(serv.Host)
+	switch qtype {
+	case dns.TypeA:
+		return ip != nil && ip.To4() != nil
+	case dns.TypeAAAA:
+		return ip != nil && ip.To4() == nil
+	case dns.TypeSRV:
+		return serv.Host != ""
+	case dns.TypeTXT:
+		return serv.Text != "" || len(serv.TXT) > 0
+	}
+	return false
+}
+
+// rdataHash returns a hash of the rdata of r, the header is not included.
+func rdataHash(r dns.RR) string {
+	h := fnv.New32a()
+	h.Write([]byte{byte(r.Header().Rrtype >> 8), byte(r.Header().Rrtype)})
+	h.Write([]byte(strings.TrimPrefix(r.String(), r.Header().String())))
+	return fmt.Sprintf("%x", h.Sum32())
+}
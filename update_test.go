@@ -0,0 +1,43 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpdateZones(t *testing.T) {
+	s := newTestServer(t, &Config{Update: true, Domains: []string{"example.org."}})
+	tests := []struct {
+		zone, rr string
+		rcode    int
+	}{
+		{"example.com.", "web.example.com. 3600 IN A 10.0.0.1", dns.RcodeNotAuth},
+		{"skydns.local.", "web.example.org. 3600 IN A 10.0.0.1", dns.RcodeNotZone},
+		{"example.org.", "web.skydns.local. 3600 IN A 10.0.0.1", dns.RcodeNotZone},
+		{"skydns.local.", "webskydns.local. 3600 IN A 10.0.0.1", dns.RcodeNotZone},
+		{"example.org.", "example.org. 3600 IN A 10.0.0.1", dns.RcodeRefused},
+		// Past the zone checks, MX isn't supported.
+		{"example.org.", "web.example.org. 3600 IN MX 10 mail.example.org.", dns.RcodeRefused},
+		{"skydns.local.", "web.skydns.local. 3600 IN MX 10 mail.skydns.local.", dns.RcodeRefused},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetUpdate(tc.zone)
+		rr, err := dns.NewRR(tc.rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Insert([]dns.RR{rr})
+		w := &dohWriter{local: &net.UDPAddr{}, remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+		s.ServeDNSUpdate(w, req)
+		if w.msg.Rcode != tc.rcode {
+			t.Errorf("%s in %s: expected rcode %s, got %s", tc.rr, tc.zone, dns.RcodeToString[tc.rcode], dns.RcodeToString[w.msg.Rcode])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// warmup tracks when services are registered, so their SRV weight can be
+// ramped up from 0 to the full value over a period of time. The times come
+// from watching etcd, services registered before we started watching, or
+// longer than period ago, get their full weight.
+type warmup struct {
+	sync.Mutex
+	period time.Duration
+	added  map[string]time.Time
+}
+
+func newWarmup(period time.Duration) *warmup {
+	return &warmup{period: period, added: make(map[string]time.Time)}
+}
+
+// watch records the registration of new services, until stop is closed. It
+// blocks, so should be run in a goroutine.
+func (w *warmup) watch(client *etcd.Client, stop chan bool) {
+	for {
+		recv := make(chan *etcd.Response)
+		go func() {
+			for r := range recv {
+				w.update(r)
+			}
+		}()
+		// Watch closes recv when it returns.
+		_, err := client.Watch("/skydns", 0, true, recv, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("error: Failure to watch etcd for new services: %q", err)
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// update records the time of a new key, a key that is set without a previous
+// value, and forgets the keys whose period has passed.
+func (w *warmup) update(r *etcd.Response) {
+	if r == nil || r.Node == nil || r.Node.Dir {
+		return
+	}
+	now := time.Now()
+	w.Lock()
+	defer w.Unlock()
+	for key, t := range w.added {
+		if now.Sub(t) >= w.period {
+			delete(w.added, key)
+		}
+	}
+	switch r.Action {
+	case "set", "create":
+		if r.PrevNode == nil {
+			w.added[r.Node.Key] = now
+		}
+	case "delete", "compareAndDelete", "expire":
+		delete(w.added, r.Node.Key)
+	}
+}
+
+// weight returns the effective weight for the service stored under key.
+func (w *warmup) weight(key string, weight uint16) uint16 {
+	w.Lock()
+	added, ok := w.added[key]
+	w.Unlock()
+	if !ok {
+		return weight
+	}
+	age := time.Since(added)
+	if age >= w.period {
+		return weight
+	}
+	return uint16(float64(weight) * float64(age) / float64(w.period))
+}
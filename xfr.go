@@ -0,0 +1,105 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ServeDNSTransfer sends the entire zone to the client (AXFR), but only over
+// TCP and only to the addresses listed in AxfrAllow. Services limited to
+// views the client's TSIG key isn't in are left out.
+func (s *server) ServeDNSTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	addr, ok := w.RemoteAddr().(*net.TCPAddr)
+	view := tsigKey(w, req)
+	if !ok || !s.transferAllowed(addr.IP, view) {
+		s.ServeDNSRefused(w, req)
+		return
+	}
+	zone := strings.ToLower(req.Question[0].Name)
+	if s.zoneOf(zone) != zone {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNotAuth)
+		w.WriteMsg(m)
+		return
+	}
+	log.Printf("Zone transfer of %q to %q", zone, addr)
+
+	records := []dns.RR{s.SOA(zone), s.NS(zone)}
+	records = append(records, s.nameserverRecords("master."+zone, dns.TypeA)...)
+	records = append(records, s.nameserverRecords("master."+zone, dns.TypeAAAA)...)
+	r, err := s.get(treePath(zone))
+	if err != nil && err != ErrNotFound {
+		log.Printf("error: Failure to transfer zone: %q", err)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	if err == nil {
+		sx, _ := s.allServices(r)
+		for _, serv := range visible(sx, view) {
+			if s.zoneOf(domain(serv.key)) != zone {
+				continue
+			}
+			records = append(records, s.transferRecords(serv)...)
+		}
+	}
+	records = append(records, s.SOA(zone))
+
+	// Send the records in chunks of 100.
+	for len(records) > 0 {
+		n := 100
+		if n > len(records) {
+			n = len(records)
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		m.Answer = records[:n]
+		if err := w.WriteMsg(m); err != nil {
+			log.Printf("error: Failure to transfer zone to %q: %q", addr, err)
+			return
+		}
+		records = records[n:]
+	}
+}
+
+// transferRecords returns the records for a single service, these are
+// owned by the name of the service's key.
+func (s *server) transferRecords(serv *Service) (records []dns.RR) {
+	if serv.NS && serv.Host != "" {
+		// The delegation and its glue.
+		var glue []dns.RR
+		ns := s.delegationRecords(delegationName(serv), serv, &glue)
+		return append([]dns.RR{ns}, glue...)
+	}
+	name := ownerName(serv.key)
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET, Ttl: serv.ttl}
+	}
+	if serv.Host != "" {
+		ip := net.ParseIP(serv.Host)
+		target := dns.Fqdn(serv.Host)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			records = append(records, &dns.A{Hdr: hdr(dns.TypeA), A: ip.To4()})
+			target = name
+		default:
+			records = append(records, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip.To16()})
+			target = name
+		}
+		records = append(records, &dns.SRV{Hdr: hdr(dns.TypeSRV), Priority: uint16(serv.Priority), Port: uint16(serv.Port), Target: target})
+	}
+	if txt, err := serv.txt(); err == nil && len(txt) > 0 {
+		records = append(records, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: txt})
+	}
+	return records
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigWriterOK is a dohWriter for clients whose TSIG signature checked out.
+type tsigWriterOK struct{ *dohWriter }
+
+func (w tsigWriterOK) TsigStatus() error { return nil }
+
+var viewServices = map[string]string{
+	"/skydns/local/skydns/web/1": `{"Host":"10.0.0.1","Port":80}`,
+	"/skydns/local/skydns/db/1":  `{"Host":"10.0.0.5","Port":5432,"Views":["backend."]}`,
+}
+
+func TestTransferViews(t *testing.T) {
+	s := newZoneServer(t, &Config{StaticNS: []string{"192.0.2.1"}, AxfrAllow: []string{"127.0.0.1"}}, viewServices)
+	for _, view := range []string{"", "backend."} {
+		req := new(dns.Msg)
+		req.SetAxfr("skydns.local.")
+		dw := &dohWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}
+		var w dns.ResponseWriter = dw
+		if view != "" {
+			req.SetTsig(view, dns.HmacMD5, 300, time.Now().Unix())
+			w = tsigWriterOK{dw}
+		}
+		s.ServeDNSTransfer(w, req)
+		msg := dw.msg
+		if msg == nil || msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("view %q: expected a zone transfer, got %v", view, msg)
+		}
+		found := false
+		for _, r := range msg.Answer {
+			found = found || r.Header().Name == "1.db.skydns.local."
+		}
+		if found != (view == "backend.") {
+			t.Errorf("view %q: expected 1.db.skydns.local. in the transfer %t, got %t", view, view == "backend.", found)
+		}
+	}
+}
+
+func TestPTRViews(t *testing.T) {
+	s := newZoneServer(t, &Config{}, viewServices)
+	q := dns.Question{Name: "5.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+	if records := s.PTRRecords(q, ""); len(records) != 0 {
+		t.Errorf("expected no PTR records outside the view, got %v", records)
+	}
+	if records := s.PTRRecords(q, "backend."); len(records) != 1 {
+		t.Errorf("expected a PTR record in the view, got %v", records)
+	}
+	q.Name = "1.0.0.10.in-addr.arpa."
+	if records := s.PTRRecords(q, ""); len(records) != 1 {
+		t.Errorf("expected a PTR record for a service without views, got %v", records)
+	}
+}
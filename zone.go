@@ -0,0 +1,362 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// zone is an in-memory copy of the /skydns tree in etcd. It is loaded once
+// at startup and kept current by watching etcd, so queries can be answered
+// without a round trip to etcd.
+type zone struct {
+	sync.RWMutex
+	client  *etcd.Client
+	root    *entry
+	index   uint64
+	grace   time.Duration
+	reverse map[string]map[string]bool // IP address to the keys that have it as Host
+}
+
+// entry is a single node in the zone.
+type entry struct {
+	key        string
+	value      string
+	dir        bool
+	expiration *time.Time
+	expired    time.Time     // when set, the key has expired in etcd
+	grace      time.Duration // from the service's StaleTTL, overrides the zone's grace
+	ip         string        // the Host of the service, when it is an address
+	children   map[string]*entry
+}
+
+// newZone returns a new zone. When grace is not zero, expired keys are kept
+// for the grace period.
+func newZone(client *etcd.Client, grace time.Duration) *zone {
+	return &zone{client: client, grace: grace, reverse: make(map[string]map[string]bool)}
+}
+
+// load fetches the entire /skydns tree from etcd, replacing what we have.
+func (z *zone) load() error {
+	r, err := z.client.Get("/skydns", false, true)
+	if err != nil {
+		return err
+	}
+	z.restore(r.Node, r.EtcdIndex)
+	return nil
+}
+
+// restore replaces the zone with the tree in n, which is at etcd index.
+func (z *zone) restore(n *etcd.Node, index uint64) {
+	root := newEntry(n)
+	z.Lock()
+	z.root = root
+	z.index = index
+	z.reverse = make(map[string]map[string]bool)
+	z.addReverse(root)
+	z.Unlock()
+}
+
+// watch keeps the zone current. It blocks, so should be run in a goroutine.
+// When the watch fails (because our index is too old for instance) the
+// complete zone is reloaded. It returns when stop is closed.
+func (z *zone) watch(stop chan bool) {
+	for {
+		recv := make(chan *etcd.Response)
+		go func() {
+			for r := range recv {
+				z.update(r)
+			}
+		}()
+		z.RLock()
+		index := z.index
+		z.RUnlock()
+		_, err := z.client.Watch("/skydns", index+1, true, recv, stop)
+		// Watch closes recv when it returns.
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("error: Failure to watch etcd: %q, reloading zone", err)
+		for {
+			if err := z.load(); err != nil {
+				log.Printf("error: Failure to load zone: %q", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// update applies a single watch event to the zone.
+func (z *zone) update(r *etcd.Response) {
+	if r == nil || r.Node == nil {
+		return
+	}
+	z.Lock()
+	defer z.Unlock()
+	if r.Node.ModifiedIndex > z.index {
+		z.index = r.Node.ModifiedIndex
+	}
+	switch r.Action {
+	case "expire":
+		e := z.search(splitKey(r.Node.Key))
+		if e == nil {
+			break
+		}
+		if z.grace == 0 && e.grace == 0 {
+			z.remove(r.Node.Key)
+			break
+		}
+		e.expire(time.Now())
+	case "delete", "compareAndDelete":
+		z.remove(r.Node.Key)
+	default: // set, create, update, compareAndSwap
+		z.insert(newEntry(r.Node))
+	}
+}
+
+// insert adds e to the zone, creating any parent directories as needed.
+func (z *zone) insert(e *entry) {
+	labels := splitKey(e.key)
+	if len(labels) == 0 {
+		return
+	}
+	if z.root == nil {
+		z.root = &entry{key: "/skydns", dir: true, children: make(map[string]*entry)}
+	}
+	parent := z.root
+	for i := 1; i < len(labels)-1; i++ {
+		p, ok := parent.children[labels[i]]
+		if !ok || !p.dir {
+			p = &entry{key: "/" + strings.Join(labels[:i+1], "/"), dir: true, children: make(map[string]*entry)}
+			parent.children[labels[i]] = p
+		}
+		parent = p
+	}
+	old, ok := parent.children[labels[len(labels)-1]]
+	if ok {
+		z.delReverse(old)
+	}
+	if e.dir && ok && old.dir {
+		// Updating a directory (i.e. its TTL) should not throw away the children.
+		e.children = old.children
+	}
+	parent.children[labels[len(labels)-1]] = e
+	z.addReverse(e)
+}
+
+// sweep periodically removes the expired entries that are past their grace
+// period. It blocks, so should be run in a goroutine. It returns when stop is
+// closed.
+func (z *zone) sweep(stop chan bool) {
+	interval := z.grace
+	if interval == 0 {
+		interval = 1 * time.Minute
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		z.Lock()
+		if z.root != nil {
+			z.root.sweep(time.Now(), z.grace)
+		}
+		z.Unlock()
+	}
+}
+
+// remove deletes the entry with key from the zone.
+func (z *zone) remove(key string) {
+	labels := splitKey(key)
+	if len(labels) == 0 {
+		return
+	}
+	parent := z.search(labels[:len(labels)-1])
+	if parent == nil {
+		return
+	}
+	if e, ok := parent.children[labels[len(labels)-1]]; ok {
+		z.delReverse(e)
+	}
+	delete(parent.children, labels[len(labels)-1])
+}
+
+// addReverse adds the addresses of e and everything below it to the reverse index.
+func (z *zone) addReverse(e *entry) {
+	if e.dir {
+		for _, c := range e.children {
+			z.addReverse(c)
+		}
+		return
+	}
+	if e.ip == "" {
+		return
+	}
+	if z.reverse[e.ip] == nil {
+		z.reverse[e.ip] = make(map[string]bool)
+	}
+	z.reverse[e.ip][e.key] = true
+}
+
+// delReverse removes the addresses of e and everything below it from the reverse index.
+func (z *zone) delReverse(e *entry) {
+	if e.dir {
+		for _, c := range e.children {
+			z.delReverse(c)
+		}
+		return
+	}
+	if e.ip == "" {
+		return
+	}
+	delete(z.reverse[e.ip], e.key)
+	if len(z.reverse[e.ip]) == 0 {
+		delete(z.reverse, e.ip)
+	}
+}
+
+// Reverse returns the keys of the services that have ip as their Host.
+func (z *zone) Reverse(ip net.IP) (keys []string) {
+	z.RLock()
+	defer z.RUnlock()
+	now := time.Now()
+	for k := range z.reverse[ip.String()] {
+		if e := z.search(splitKey(k)); e != nil && !e.gone(now, z.grace) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// search returns the entry for labels or nil when not found.
+func (z *zone) search(labels []string) *entry {
+	if len(labels) == 0 || z.root == nil {
+		return nil
+	}
+	e := z.root
+	for _, l := range labels[1:] {
+		if e.children == nil {
+			return nil
+		}
+		c, ok := e.children[l]
+		if !ok {
+			return nil
+		}
+		e = c
+	}
+	return e
+}
+
+// Get mimics etcd.Client.Get with recursive set to true, but answers from memory.
+// When key can not be found ErrNotFound is returned.
+func (z *zone) Get(key string) (*etcd.Response, error) {
+	z.RLock()
+	defer z.RUnlock()
+	e := z.search(splitKey(key))
+	now := time.Now()
+	if e == nil || e.gone(now, z.grace) {
+		return nil, ErrNotFound
+	}
+	return &etcd.Response{Action: "get", Node: e.node(now, z.grace), EtcdIndex: z.index}, nil
+}
+
+// newEntry converts an etcd node (and its children) to an entry.
+func newEntry(n *etcd.Node) *entry {
+	e := &entry{key: n.Key, value: n.Value, dir: n.Dir, expiration: n.Expiration}
+	if !n.Dir {
+		serv := new(Service)
+		if err := json.Unmarshal([]byte(n.Value), serv); err == nil {
+			e.grace = time.Duration(serv.StaleTTL) * time.Second
+			if ip := net.ParseIP(serv.Host); ip != nil {
+				e.ip = ip.String()
+			}
+		}
+	}
+	if n.Dir {
+		e.children = make(map[string]*entry)
+		for _, c := range n.Nodes {
+			labels := splitKey(c.Key)
+			if len(labels) == 0 {
+				continue
+			}
+			e.children[labels[len(labels)-1]] = newEntry(c)
+		}
+	}
+	return e
+}
+
+// node converts an entry (and its children) back into an etcd node. Expired
+// entries get a negative TTL, entries past their grace period are left out.
+func (e *entry) node(now time.Time, grace time.Duration) *etcd.Node {
+	n := &etcd.Node{Key: e.key, Value: e.value, Dir: e.dir, Expiration: e.expiration}
+	switch {
+	case !e.expired.IsZero():
+		n.TTL = -1
+	case e.expiration != nil:
+		n.TTL = int64(e.expiration.Sub(now)/time.Second) + 1
+		if n.TTL < 1 {
+			n.TTL = 1
+		}
+	}
+	for _, c := range e.children {
+		if c.gone(now, grace) {
+			continue
+		}
+		n.Nodes = append(n.Nodes, c.node(now, grace))
+	}
+	return n
+}
+
+// expire marks e and everything below it as expired.
+func (e *entry) expire(now time.Time) {
+	e.expired = now
+	for _, c := range e.children {
+		c.expire(now)
+	}
+}
+
+// gone returns true when e expired and is past its grace period, which is
+// grace unless the service set its own.
+func (e *entry) gone(now time.Time, grace time.Duration) bool {
+	if e.grace > 0 {
+		grace = e.grace
+	}
+	return !e.expired.IsZero() && e.expired.Add(grace).Before(now)
+}
+
+// sweep removes the children of e that are past their grace period.
+func (e *entry) sweep(now time.Time, grace time.Duration) {
+	for l, c := range e.children {
+		if c.gone(now, grace) {
+			delete(e.children, l)
+			continue
+		}
+		c.sweep(now, grace)
+	}
+}
+
+// splitKey splits an etcd key into its labels, /skydns/local is split into
+// "skydns", "local".
+func splitKey(key string) []string {
+	key = strings.Trim(key, "/")
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "/")
+}
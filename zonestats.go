@@ -0,0 +1,157 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+)
+
+// zoneCounts is what is registered in our zones, for capacity planning.
+type zoneCounts struct {
+	Services  int            `json:"services"`
+	Addresses int            `json:"addresses"` // distinct addresses
+	CNAMEs    int            `json:"cnames"`    // services with a name as Host
+	Subtrees  map[string]int `json:"subtrees"`  // services per name directly below a zone, i.e. the environments
+	Time      time.Time      `json:"time"`
+
+	// Duplicates maps a Host and Port registered by services under sibling
+	// keys, usually a copy-paste error, to these keys. These don't skew the
+	// SRV weights, see srvWeights, but do make answers larger than they
+	// should be.
+	Duplicates map[string][]string `json:"duplicates"`
+}
+
+var (
+	zoneCountsLock sync.Mutex
+	zoneCountsLast *zoneCounts
+
+	// The duplicate registrations already logged, as host:port and key.
+	loggedDuplicates = make(map[string]bool)
+)
+
+func init() {
+	expvar.Publish("skydns_zone_counts", expvar.Func(func() interface{} {
+		zoneCountsLock.Lock()
+		defer zoneCountsLock.Unlock()
+		return zoneCountsLast
+	}))
+}
+
+// zoneStats counts what is registered in our zones every interval, from the
+// in-memory zone when we have one, otherwise from etcd. It blocks, so should
+// be run in a goroutine. It returns when the server is stopped.
+func (s *server) zoneStats(interval time.Duration) {
+	for {
+		c, err := s.countZones()
+		if err != nil {
+			log.Printf("error: Failure to count zones: %q", err)
+		} else {
+			zoneCountsLock.Lock()
+			zoneCountsLast = c
+			zoneCountsLock.Unlock()
+			logDuplicates(c.Duplicates)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *server) countZones() (*zoneCounts, error) {
+	c := &zoneCounts{Subtrees: make(map[string]int), Duplicates: make(map[string][]string), Time: time.Now()}
+	addrs := make(map[string]bool)
+	for _, zone := range append([]string{s.config.Domain}, s.config.Domains...) {
+		r, err := s.get(treePath(zone))
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		s.countNode(c, addrs, zone, r.Node)
+	}
+	c.Addresses = len(addrs)
+	return c, nil
+}
+
+// countNode adds the services in n, which is in zone, to c. Subtrees that
+// belong to another of our zones are counted there.
+func (s *server) countNode(c *zoneCounts, addrs map[string]bool, zone string, n *etcd.Node) {
+	if n.Key != treePath(zone) && s.zoneOf(domain(n.Key)) != zone {
+		return
+	}
+	if n.Dir {
+		first := make(map[string]string) // host:port to the first key registering it
+		for _, child := range n.Nodes {
+			s.countNode(c, addrs, zone, child)
+			hp := hostPort(child)
+			if hp == "" {
+				continue
+			}
+			if key, ok := first[hp]; ok {
+				if len(c.Duplicates[hp]) == 0 {
+					c.Duplicates[hp] = []string{key}
+				}
+				c.Duplicates[hp] = append(c.Duplicates[hp], child.Key)
+				continue
+			}
+			first[hp] = child.Key
+		}
+		return
+	}
+	serv := new(Service)
+	if err := json.Unmarshal([]byte(n.Value), serv); err != nil {
+		return
+	}
+	c.Services++
+	switch ip := net.ParseIP(serv.Host); {
+	case ip != nil:
+		addrs[ip.String()] = true
+	case serv.Host != "":
+		c.CNAMEs++
+	}
+	if l := dns.SplitDomainName(domain(n.Key)); len(l) > dns.CountLabel(zone) {
+		c.Subtrees[dns.Fqdn(l[len(l)-dns.CountLabel(zone)-1])+zone]++
+	}
+}
+
+// hostPort returns the Host and Port of the service in n, or "" when n is not
+// a service with a Host.
+func hostPort(n *etcd.Node) string {
+	if n.Dir {
+		return ""
+	}
+	serv := new(Service)
+	if err := json.Unmarshal([]byte(n.Value), serv); err != nil || serv.Host == "" {
+		return ""
+	}
+	return net.JoinHostPort(serv.Host, strconv.Itoa(serv.Port))
+}
+
+// logDuplicates logs the duplicate registrations in duplicates that were not
+// logged before, so each is logged once.
+func logDuplicates(duplicates map[string][]string) {
+	logged := make(map[string]bool)
+	for hp, keys := range duplicates {
+		for _, key := range keys[1:] {
+			logged[hp+" "+key] = true
+			if !loggedDuplicates[hp+" "+key] {
+				log.Printf("error: Duplicate registration of %q in %q and %q", hp, keys[0], key)
+			}
+		}
+	}
+	loggedDuplicates = logged
+}